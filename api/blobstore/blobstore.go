@@ -0,0 +1,16 @@
+package blobstore
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps file contents, such as message attachments, outside the
+// database. Keys are generated by the caller and are opaque to the store.
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
@@ -0,0 +1,66 @@
+package connectionManager
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/thaironsilva/messenger/api/resource/message"
+)
+
+// Delivery is a live message or event on its way to the sessions of the
+// user To, in their conversation with the user From. Both are usernames.
+type Delivery struct {
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+	Message *message.Message `json:"message,omitempty"`
+	// MessageId stands for Message when it is too large for the broker,
+	// and the message is loaded back from storage on delivery.
+	MessageId string `json:"messageId,omitempty"`
+	Event     *Event `json:"event,omitempty"`
+	// Session is the session a message was sent from. The sender's other
+	// sessions get a copy of the message, this one doesn't.
+	Session string `json:"session,omitempty"`
+}
+
+// Event is a receipt, typing indicator or reaction, as pushed to clients.
+type Event struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Broker carries deliveries to every instance of the app, the one
+// publishing included, so users connected to different instances can chat
+// live.
+type Broker interface {
+	Publish(delivery Delivery) error
+	// Subscribe registers handle to be called with every delivery
+	// published, in the order they were published.
+	Subscribe(handle func(delivery Delivery))
+}
+
+// MemoryBroker is the Broker of a single instance.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers []func(delivery Delivery)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(delivery Delivery) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handle := range b.handlers {
+		handle(delivery)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handle func(delivery Delivery)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, handle)
+}
@@ -0,0 +1,104 @@
+package connectionManager
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPingInterval   = 30 * time.Second
+	defaultPongTimeout    = 60 * time.Second
+	defaultWriteTimeout   = 10 * time.Second
+	defaultMaxMessageSize = 64 << 10
+	defaultQueueSize      = 256
+)
+
+// What to do with a session whose outbound queue is full.
+const (
+	// overflowDrop drops what doesn't fit and tells the client how much it
+	// lost. Dropped messages are replayed from storage instead; receipts
+	// are persisted too, and typing indicators are stale by the time a
+	// client falls that far behind.
+	overflowDrop = "drop"
+	// overflowDisconnect closes the socket with closeTooSlow.
+	overflowDisconnect = "disconnect"
+)
+
+// socketConfig tunes the sockets of every session.
+type socketConfig struct {
+	// pingInterval is how often the server pings clients.
+	pingInterval time.Duration
+	// pongTimeout is how long a client may stay silent, pongs included,
+	// before its session is closed.
+	pongTimeout time.Duration
+	// writeTimeout bounds every write to a client.
+	writeTimeout time.Duration
+	// maxMessageSize is the largest frame, in bytes, a client may send.
+	maxMessageSize int64
+	// queueSize is how many messages and events may wait for a client.
+	queueSize int
+	// overflow is overflowDrop or overflowDisconnect.
+	overflow string
+}
+
+// loadSocketConfig reads WS_PING_INTERVAL, WS_PONG_TIMEOUT and
+// WS_WRITE_TIMEOUT as durations ("30s"), WS_MAX_MESSAGE_BYTES, WS_QUEUE_SIZE
+// and WS_OVERFLOW_POLICY.
+func loadSocketConfig() socketConfig {
+	config := socketConfig{
+		pingInterval:   durationEnv("WS_PING_INTERVAL", defaultPingInterval),
+		pongTimeout:    durationEnv("WS_PONG_TIMEOUT", defaultPongTimeout),
+		writeTimeout:   durationEnv("WS_WRITE_TIMEOUT", defaultWriteTimeout),
+		maxMessageSize: defaultMaxMessageSize,
+		queueSize:      defaultQueueSize,
+		overflow:       overflowDrop,
+	}
+
+	if value := os.Getenv("WS_MAX_MESSAGE_BYTES"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			config.maxMessageSize = size
+		} else {
+			fmt.Println("invalid WS_MAX_MESSAGE_BYTES, using the default")
+		}
+	}
+
+	if value := os.Getenv("WS_QUEUE_SIZE"); value != "" {
+		if size, err := strconv.Atoi(value); err == nil && size > 0 {
+			config.queueSize = size
+		} else {
+			fmt.Println("invalid WS_QUEUE_SIZE, using the default")
+		}
+	}
+
+	switch policy := os.Getenv("WS_OVERFLOW_POLICY"); policy {
+	case "":
+	case overflowDrop, overflowDisconnect:
+		config.overflow = policy
+	default:
+		fmt.Println("invalid WS_OVERFLOW_POLICY, using the default")
+	}
+
+	// clients must get a ping before they time out
+	if config.pingInterval >= config.pongTimeout {
+		fmt.Println("WS_PING_INTERVAL must be shorter than WS_PONG_TIMEOUT, pinging more often")
+		config.pingInterval = config.pongTimeout * 9 / 10
+	}
+
+	return config
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		fmt.Println("invalid " + name + ", using the default")
+		return fallback
+	}
+	return duration
+}
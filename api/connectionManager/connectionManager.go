@@ -1,144 +1,721 @@
 package connectionManager
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/thaironsilva/messenger/api/cognitoClient"
+	"github.com/thaironsilva/messenger/api/resource/attachment"
 	"github.com/thaironsilva/messenger/api/resource/message"
+	"github.com/thaironsilva/messenger/api/resource/ticket"
 	"github.com/thaironsilva/messenger/api/resource/user"
 
 	"github.com/gorilla/websocket"
 )
 
+var badRequestResponse = []byte(`{"message":"bad request"}`)
+var forbiddenOriginResponse = []byte(`{"message":"origin not allowed"}`)
+var invalidDeviceResponse = []byte(`{"message":"device must be at most 64 characters"}`)
+var invalidTicketResponse = []byte(`{"message":"invalid or expired ticket"}`)
+var notFoundResponse = []byte(`{"message":"user not found"}`)
+var unauthorizedResponse = []byte(`{"message":"unauthorized token"}`)
+var wrongTicketResponse = []byte(`{"message":"ticket not valid for this conversation"}`)
+
+const (
+	frameMessage  = "message"
+	frameReceived = "received"
+)
+
+// replayBatch is how many stored messages are loaded at a time when
+// replaying the ones a client missed.
+const replayBatch = 100
+
+// frame is a JSON object sent by a client over the chat socket. Plain JSON
+// strings are still read as message frames carrying just a body. ClientId
+// is chosen by the client to match the ack of a message frame to it, and
+// IdempotencyKey to send the message again without storing it twice. Seq is
+// the last message a received frame acknowledges, 0 for all of those
+// written to the socket.
+type frame struct {
+	Type           string   `json:"type"`
+	Id             string   `json:"-"`
+	ClientId       string   `json:"clientId"`
+	IdempotencyKey *string  `json:"idempotencyKey"`
+	Body           string   `json:"body"`
+	Format         string   `json:"format"`
+	ReplyToId      *string  `json:"replyToId"`
+	AttachmentIds  []string `json:"attachmentIds"`
+	Seq            int64    `json:"seq"`
+}
+
+func decodeFrame(raw json.RawMessage) (frame, error) {
+	var body string
+	if err := json.Unmarshal(raw, &body); err == nil {
+		return frame{Type: frameMessage, Body: body}, nil
+	}
+
+	var f frame
+	err := json.Unmarshal(raw, &f)
+	return f, err
+}
+
+// errorEvent tells a client that one of its frames was rejected.
+type errorEvent struct {
+	Type     string `json:"type"`
+	ClientId string `json:"clientId,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ConnectionHandler routes messages and events between the sessions of
+// connected users.
 type ConnectionHandler struct {
 	messageStorage message.Storage
 	userStorage    user.Storage
+	tickets        ticket.Storage
 	cognito        cognitoClient.CognitoInterface
-	Clients        map[string]*websocket.Conn
-	Channels       map[string]chan string
-	mu             sync.Mutex
+	broker         Broker
+	sessions       *registry
+	pollers        *pollers
+	config         socketConfig
+	origins        originPolicy
+	upgrader       websocket.Upgrader
+	// dropped and disconnected count the overflows of outbound queues.
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+	// closing is set, and stopping closed, once Shutdown is called.
+	closing  atomic.Bool
+	stopping chan struct{}
 }
 
-func NewConnectionHandler(messageStorage message.Storage, userStorage user.Storage, cognito cognitoClient.CognitoInterface) *ConnectionHandler {
-	return &ConnectionHandler{
+func NewConnectionHandler(messageStorage message.Storage, userStorage user.Storage, tickets ticket.Storage, cognito cognitoClient.CognitoInterface, broker Broker) *ConnectionHandler {
+	h := &ConnectionHandler{
 		messageStorage: messageStorage,
 		userStorage:    userStorage,
+		tickets:        tickets,
 		cognito:        cognito,
-		Clients:        make(map[string]*websocket.Conn),
-		Channels:       make(map[string]chan string),
+		broker:         broker,
+		sessions:       newRegistry(),
+		pollers:        newPollers(),
+		stopping:       make(chan struct{}),
+		config:         loadSocketConfig(),
+		origins:        loadOriginPolicy(),
 	}
+	h.upgrader = websocket.Upgrader{CheckOrigin: h.checkOrigin}
+	broker.Subscribe(h.dispatch)
+	return h
 }
 
-func (h *ConnectionHandler) HandleConnections(w http.ResponseWriter, r *http.Request) {
-	var upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+// Shutdown closes every session with a going away close frame, once the
+// messages and events queued for it are written. It returns when all the
+// sessions are closed or ctx is done, closing the remaining ones at once.
+// Sessions opened during a shutdown are closed as soon as they start, and
+// long polls answer at once.
+func (h *ConnectionHandler) Shutdown(ctx context.Context) error {
+	if !h.closing.Swap(true) {
+		close(h.stopping)
+	}
+
+	sessions := h.sessions.all()
+	for _, s := range sessions {
+		s.drain()
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	for _, s := range sessions {
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+			for _, s := range sessions {
+				s.cancel()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Notify publishes event for the sessions of "to" following their
+// conversation with "from", on any instance. It never blocks: sessions
+// falling behind get the overflow policy.
+func (h *ConnectionHandler) Notify(from string, to string, event any) {
+	payload, err := json.Marshal(event)
 	if err != nil {
-		fmt.Println("upgrade failed: ", err)
+		fmt.Println("invalid event: ", err)
 		return
 	}
 
-	defer conn.Close()
+	delivery := Delivery{From: from, To: to, Event: &Event{Type: eventType(event), Payload: payload}}
+	if err := h.broker.Publish(delivery); err != nil {
+		fmt.Println("error publishing event: ", err)
+	}
+}
 
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if token == "" {
-		fmt.Println("message: unauthorized")
+// Deliver publishes msg, sent from "from" to "to" without a session, for
+// the sessions of both of them following their conversation, on any
+// instance.
+func (h *ConnectionHandler) Deliver(from string, to string, msg message.Message) {
+	delivery := Delivery{From: from, To: to, Message: &msg}
+	if err := h.broker.Publish(delivery); err != nil {
+		fmt.Println("error publishing message: ", err)
+	}
+}
+
+// deliver publishes msg, sent from the session from to receiver.
+func (h *ConnectionHandler) deliver(from *session, receiver user.User, msg message.Message) {
+	delivery := Delivery{From: from.user.Username, To: receiver.Username, Message: &msg, Session: from.id}
+	if err := h.broker.Publish(delivery); err != nil {
+		fmt.Println("error publishing message: ", err)
+	}
+}
+
+// dispatch queues a delivery for the sessions of this instance. A message
+// goes to every session of the receiver following the conversation, and to
+// the sender's other /api/v0/ws sessions following it, so all their devices
+// show the message; legacy sessions can't tell a copy from a received
+// message.
+func (h *ConnectionHandler) dispatch(d Delivery) {
+	if d.Event != nil {
+		for _, f := range h.followers(d.To, d.From) {
+			f.session.push(outbound{peer: f.peer, event: *d.Event})
+		}
 		return
 	}
 
-	cognitoUser, err := h.cognito.GetUserByToken(token)
-	if err != nil {
-		fmt.Println(err)
+	msg := d.Message
+	if msg == nil {
+		stored, err := h.messageStorage.GetById(d.MessageId)
+		if err != nil {
+			fmt.Println("error loading delivered message: ", err)
+			return
+		}
+		msg = &stored
+	}
+
+	h.pollers.wake(d.To)
+
+	for _, f := range h.followers(d.To, d.From) {
+		f.session.push(outbound{peer: f.peer, msg: msg})
+	}
+
+	if d.To == d.From {
 		return
 	}
 
-	var email string
+	for _, f := range h.followers(d.From, d.To) {
+		if f.session.id != d.Session && !f.session.legacy {
+			f.session.push(outbound{peer: f.peer, msg: msg, own: true})
+		}
+	}
+}
 
-	for _, attribute := range cognitoUser.UserAttributes {
-		if *attribute.Name == "email" {
-			email = *attribute.Value
+// follower is a session following a conversation with peer.
+type follower struct {
+	session *session
+	peer    user.User
+}
+
+// followers lists the sessions of username following its conversation with
+// peer.
+func (h *ConnectionHandler) followers(username string, peer string) []follower {
+	var followers []follower
+	for _, s := range h.sessions.of(username) {
+		if c, ok := s.following(peer); ok {
+			followers = append(followers, follower{session: s, peer: c.peer})
 		}
 	}
+	return followers
+}
 
-	sender, err := h.userStorage.GetByEmail(email)
-	if err != nil {
-		fmt.Println("get sender failed", err)
+// ticketProtocolPrefix prefixes tickets passed as a Sec-WebSocket-Protocol,
+// the only header browsers let scripts set on a handshake.
+const ticketProtocolPrefix = "ticket."
+
+// upgrade switches r to the websocket protocol, selecting the ticket
+// protocol the client offered, as browsers require.
+func (h *ConnectionHandler) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	header := http.Header{}
+	if protocol := ticketProtocol(r); protocol != "" {
+		header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	return h.upgrader.Upgrade(w, r, header)
+}
+
+// requestTicket is the ticket r carries as its ticket query parameter or
+// its ticket protocol, if any.
+func requestTicket(r *http.Request) string {
+	if token := r.URL.Query().Get("ticket"); token != "" {
+		return token
+	}
+	return strings.TrimPrefix(ticketProtocol(r), ticketProtocolPrefix)
+}
+
+func ticketProtocol(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, ticketProtocolPrefix) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// checkOrigin keeps other websites from opening sockets with the
+// credentials of their visitors.
+func (h *ConnectionHandler) checkOrigin(r *http.Request) bool {
+	if h.origins.allows(r) {
+		return true
+	}
+	fmt.Println("rejecting websocket upgrade from origin ", r.Header.Get("Origin"))
+	return false
+}
+
+// HandleConnections serves /api/v0/chat/{username}, a socket carrying the
+// conversation of the token user with username only. It is kept for the
+// clients that predate /api/v0/ws.
+func (h *ConnectionHandler) HandleConnections(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(r) {
+		writeError(w, http.StatusForbidden, forbiddenOriginResponse)
 		return
 	}
 
 	username := strings.TrimPrefix(r.URL.Path, "/api/v0/chat/")
 	if username == "" {
-		fmt.Println("message: not found")
+		writeError(w, http.StatusNotFound, notFoundResponse)
 		return
 	}
 
-	receiver, err := h.userStorage.GetByUsername(username)
+	sender, receiver, ok := h.authenticate(w, r, username)
+	if !ok {
+		return
+	}
+
+	device, ok := deviceId(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := h.upgrade(w, r)
 	if err != nil {
-		fmt.Println("get receiver failed: ", err)
+		fmt.Println("upgrade failed: ", err)
 		return
 	}
 
-	h.mu.Lock()
-	h.Clients[sender.Username+"-"+receiver.Username] = conn
-	h.Channels[receiver.Username+"-"+sender.Username] = make(chan string)
-	h.mu.Unlock()
+	defer conn.Close()
+
+	s := newSession(r.Context(), h, sender, conn, true)
+	s.device = device
+	s.fullMessages = r.URL.Query().Get("messages") == "full"
+	s.follow(receiver)
+	h.sessions.add(s)
 
 	defer func() {
-		h.mu.Lock()
-		delete(h.Clients, sender.Username+"-"+receiver.Username)
-		delete(h.Channels, receiver.Username+"-"+sender.Username)
-		h.mu.Unlock()
+		h.sessions.remove(s)
+		s.close()
 	}()
 
-	// receive messages
-	go func() {
-		for {
-			receiveChannel, open := h.Channels[receiver.Username+"-"+sender.Username]
-			if !open {
-				return
-			}
-
-			msg := <-receiveChannel
+	s.start()
 
-			myConn, connected := h.Clients[sender.Username+"-"+receiver.Username]
-			if !connected {
-				return
-			}
-
-			err := myConn.WriteJSON(msg)
-			if err != nil {
-				fmt.Println("error receiving message: ", err)
-			}
-		}
-	}()
+	if h.closing.Load() {
+		s.drain()
+	}
 
 	// send messages
 	for {
-		var msg string
-		err := conn.ReadJSON(&msg)
+		var raw json.RawMessage
+		err := s.read(&raw)
 		if err != nil {
 			fmt.Println("error sending message: ", err)
 			return
 		}
 
-		newMessage := message.Message{SenderId: sender.Id, ReceiverId: receiver.Id, Body: msg, CreatedAt: time.Now().UTC()}
+		f, err := decodeFrame(raw)
+		if err != nil {
+			fmt.Println("invalid frame: ", err)
+			continue
+		}
 
-		if err := h.messageStorage.Create(newMessage); err != nil {
+		c, _ := s.following(receiver.Username)
+		if err := h.handleFrame(s, c, f); err != nil {
 			fmt.Println("Error occurred while trying to create message:", err)
+			s.closeWith(websocket.CloseInternalServerErr, "internal error")
+			return
+		}
+	}
+}
+
+// HandleSocket serves /api/v0/ws, a socket carrying all the conversations
+// of the token user. Clients subscribe to the conversations they want
+// delivered, by the username of the other participant, and exchange
+// envelopes tagged with it.
+func (h *ConnectionHandler) HandleSocket(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(r) {
+		writeError(w, http.StatusForbidden, forbiddenOriginResponse)
+		return
+	}
+
+	current, _, ok := h.authenticate(w, r, "")
+	if !ok {
+		return
+	}
+
+	device, ok := deviceId(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := h.upgrade(w, r)
+	if err != nil {
+		fmt.Println("upgrade failed: ", err)
+		return
+	}
+
+	defer conn.Close()
+
+	s := newSession(r.Context(), h, current, conn, false)
+	s.device = device
+	h.sessions.add(s)
+
+	defer func() {
+		h.sessions.remove(s)
+		s.close()
+	}()
+
+	s.start()
+
+	if h.closing.Load() {
+		s.drain()
+	}
+
+	s.push(outbound{event: sessionEvent{Id: s.id}})
+
+	for {
+		var e envelope
+		if err := s.read(&e); err != nil {
+			fmt.Println("error reading envelope: ", err)
+			return
+		}
+
+		if err := h.handleEnvelope(s, e); err != nil {
+			fmt.Println("Error occurred while handling envelope:", err)
+			s.closeWith(websocket.CloseInternalServerErr, "internal error")
 			return
 		}
+	}
+}
+
+// handleEnvelope acts on an envelope sent over a /api/v0/ws session. Errors
+// the client can fix are sent back to it; the others close the session.
+func (h *ConnectionHandler) handleEnvelope(s *session, e envelope) error {
+	reject := func(peer user.User, err error) {
+		s.push(outbound{peer: peer, id: e.Id, event: errorEvent{Type: envelopeError, Message: err.Error()}})
+	}
+
+	switch e.Type {
+	case envelopeSubscribe:
+		peer, err := h.userStorage.GetByUsername(e.Conversation)
+		if err != nil || e.Conversation == "" {
+			reject(user.User{Username: e.Conversation}, errUnknownConversation)
+			return nil
+		}
+		s.follow(peer)
+		s.push(outbound{peer: peer, id: e.Id, event: ack{Type: envelopeSubscribed}})
+		return nil
+	case envelopeUnsubscribe:
+		s.unfollow(e.Conversation)
+		s.push(outbound{peer: user.User{Username: e.Conversation}, id: e.Id, event: ack{Type: envelopeUnsubscribed}})
+		return nil
+	}
+
+	c, ok := s.following(e.Conversation)
+	if !ok {
+		reject(user.User{Username: e.Conversation}, errNotSubscribed)
+		return nil
+	}
+
+	f := frame{Type: e.Type}
+	if e.Type == frameMessage || (e.Type == frameReceived && len(e.Payload) > 0) {
+		if err := json.Unmarshal(e.Payload, &f); err != nil {
+			reject(c.peer, err)
+			return nil
+		}
+		f.Type = e.Type
+	}
+	f.Id = e.Id
+
+	return h.handleFrame(s, c, f)
+}
+
+var errUnknownConversation = errors.New("conversation user not found")
+var errNotSubscribed = errors.New("not subscribed to conversation")
+
+// handleFrame acts on a frame s sent to the conversation c. It only fails
+// when the session can't go on.
+func (h *ConnectionHandler) handleFrame(s *session, c *conversation, f frame) error {
+	switch f.Type {
+	case frameMessage:
+		c.typing.stop()
+		return h.send(s, c.peer, f)
+	case frameReceived:
+		// the writer knows what was written to the socket
+		s.enqueue(outbound{peer: c.peer, received: true, seq: f.Seq})
+	case message.ReceiptRead:
+		now := time.Now().UTC()
+		ids, err := h.messageStorage.MarkRead(s.user.Id, c.peer.Id, now)
+		if err != nil {
+			fmt.Println("error marking messages as read: ", err)
+			return nil
+		}
+		if len(ids) > 0 {
+			h.Notify(s.user.Username, c.peer.Username, message.Receipt{Type: message.ReceiptRead, MessageIds: ids, At: now})
+		}
+	case typingStart, typingStop:
+		if !s.typingFrames.allow() {
+			return nil
+		}
+		if f.Type == typingStart {
+			c.typing.start()
+		} else {
+			c.typing.stop()
+		}
+	default:
+		fmt.Println("unknown frame type: ", f.Type)
+	}
+	return nil
+}
+
+// send stores the message frame f from s to receiver and delivers it.
+// Invalid messages are rejected back to s. A message sent again with the
+// same idempotency key is acked with the stored one, but not delivered
+// again.
+func (h *ConnectionHandler) send(s *session, receiver user.User, f frame) error {
+	newMessage := message.Message{
+		SenderId:       s.user.Id,
+		ReceiverId:     receiver.Id,
+		Body:           f.Body,
+		Format:         f.Format,
+		ReplyToId:      f.ReplyToId,
+		AttachmentIds:  f.AttachmentIds,
+		IdempotencyKey: f.IdempotencyKey,
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	err := message.Validate(newMessage)
+	if err == nil {
+		err = message.CheckReply(h.messageStorage, newMessage)
+	}
+	if err == nil {
+		newMessage, err = message.Render(newMessage)
+	}
+	duplicate := false
+	if err == nil {
+		newMessage, err = h.messageStorage.Create(newMessage)
+		if errors.Is(err, message.ErrDuplicateMessage) {
+			duplicate, err = true, nil
+		}
+		if err != nil && !errors.Is(err, attachment.ErrInvalidAttachment) && !errors.Is(err, message.ErrKeyReused) {
+			return err
+		}
+	}
+	if err != nil {
+		fmt.Println("invalid message: ", err)
+		s.push(outbound{peer: receiver, id: f.Id, event: errorEvent{Type: envelopeError, ClientId: f.ClientId, Message: err.Error()}})
+		return nil
+	}
+
+	// clients that don't name their frames don't expect acks
+	if f.ClientId != "" || f.Id != "" {
+		s.push(outbound{peer: receiver, id: f.Id, event: messageAck{Type: envelopeAck, ClientId: f.ClientId, Id: newMessage.Id, CreatedAt: newMessage.CreatedAt}})
+	}
+	if !duplicate {
+		h.deliver(s, receiver, newMessage)
+	}
+	return nil
+}
+
+// authenticate returns the user of the request's ticket or, for clients
+// that can set headers, of its bearer token, and the peer named username.
+// The peer is only looked up once the caller is known, so that strangers
+// can't probe which usernames exist. Tickets must be bound to the
+// conversation with the peer, or to /api/v0/ws when username is empty. It
+// answers the requests it rejects, before they are upgraded.
+func (h *ConnectionHandler) authenticate(w http.ResponseWriter, r *http.Request, username string) (user.User, user.User, bool) {
+	current, t, ok := h.identify(w, r)
+	if !ok {
+		return current, user.User{}, false
+	}
+
+	var peer user.User
+
+	if username != "" {
+		var err error
+		peer, err = h.userStorage.GetByUsername(username)
+		if err != nil {
+			writeUserError(w, err)
+			return current, peer, false
+		}
+	}
+
+	if t != nil && !t.Allows(peer.Id) {
+		writeError(w, http.StatusForbidden, wrongTicketResponse)
+		return current, peer, false
+	}
+
+	return current, peer, true
+}
+
+// identify returns the user of the request's ticket, along with the
+// ticket, or of its bearer token.
+func (h *ConnectionHandler) identify(w http.ResponseWriter, r *http.Request) (user.User, *ticket.Ticket, bool) {
+	if token := requestTicket(r); token != "" {
+		t, err := h.tickets.Redeem(token, time.Now().UTC())
+		if errors.Is(err, ticket.ErrInvalidTicket) {
+			writeError(w, http.StatusUnauthorized, invalidTicketResponse)
+			return user.User{}, nil, false
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, []byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return user.User{}, nil, false
+		}
+		return t.User, &t, true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		writeError(w, http.StatusBadRequest, badRequestResponse)
+		return user.User{}, nil, false
+	}
+
+	cognitoUser, err := h.cognito.GetUserByToken(token)
+	if err != nil {
+		if err.Error() == "NotAuthorizedException: Could not verify signature for Access Token" {
+			writeError(w, http.StatusUnauthorized, unauthorizedResponse)
+			return user.User{}, nil, false
+		}
+		writeError(w, http.StatusInternalServerError, []byte(fmt.Sprintf(`{"message": %s}`, err)))
+		return user.User{}, nil, false
+	}
+
+	var email string
+
+	for _, attribute := range cognitoUser.UserAttributes {
+		if *attribute.Name == "email" {
+			email = *attribute.Value
+		}
+	}
+
+	current, err := h.userStorage.GetByEmail(email)
+	if err != nil {
+		writeUserError(w, err)
+		return current, nil, false
+	}
+
+	return current, nil, true
+}
+
+// maxDeviceLength is the length of the device_id column of delivery_cursors.
+const maxDeviceLength = 64
+
+// deviceId returns the device parameter of r, which keeps the delivery
+// cursors of a client apart from those of the user's other clients. Clients
+// without one share theirs.
+func deviceId(w http.ResponseWriter, r *http.Request) (string, bool) {
+	device := r.URL.Query().Get("device")
+	if len(device) > maxDeviceLength {
+		writeError(w, http.StatusBadRequest, invalidDeviceResponse)
+		return "", false
+	}
+	return device, true
+}
+
+func writeError(w http.ResponseWriter, status int, response []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	if err.Error() == "sql: no rows in result set" {
+		writeError(w, http.StatusNotFound, notFoundResponse)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, []byte(fmt.Sprintf(`{"message": %s}`, err)))
+}
+
+// replay writes to s, in order, the messages peer sent to s's user after
+// the delivery cursor of s's device, leaving out those written already. It
+// starts no further back than written remembers, and records what it
+// writes there. A resumed stream starts from its Last-Event-ID instead,
+// which acknowledges the messages up to it.
+func (h *ConnectionHandler) replay(s *session, peer user.User, written *sent) error {
+	cursor, err := h.messageStorage.GetCursor(s.user.Id, peer.Id, s.device)
+	if err != nil {
+		return err
+	}
+	// a new device starts from the cursor of another one, and keeps it
+	// even if that one moves on before it acknowledges anything
+	if s.device != "" {
+		if err := h.messageStorage.AdvanceCursor(s.user.Id, peer.Id, s.device, cursor); err != nil {
+			return err
+		}
+	}
+	if s.stream != nil {
+		if id, ok := s.stream.resume(peer.Username); ok {
+			h.acknowledge(s.user, peer, s.device, id)
+			cursor = id
+		}
+	}
+	cursor = max(cursor, written.cursor-sentWindow)
 
-		sendChannel, open := h.Channels[sender.Username+"-"+receiver.Username]
-		if open {
-			sendChannel <- msg
+	for {
+		messages, err := h.messageStorage.GetUndelivered(s.user.Id, peer.Id, cursor, replayBatch)
+		if err != nil {
+			return err
 		}
+
+		for _, msg := range messages {
+			cursor = msg.Seq
+			if !written.add(msg.Seq) {
+				continue
+			}
+			if err := s.writeMessage(peer, msg); err != nil {
+				return err
+			}
+		}
+
+		if len(messages) < replayBatch {
+			if s.stream != nil {
+				s.stream.replayed(peer.Username)
+			}
+			return nil
+		}
+	}
+}
+
+// acknowledge records that the device client of reader processed the
+// messages peer sent up to seq: they are not replayed to it again, and
+// they are marked delivered.
+func (h *ConnectionHandler) acknowledge(reader user.User, peer user.User, device string, seq int64) {
+	if err := h.messageStorage.AdvanceCursor(reader.Id, peer.Id, device, seq); err != nil {
+		fmt.Println("error advancing delivery cursor: ", err)
+		return
+	}
+	h.markDelivered(reader, peer, seq)
+}
+
+// markDelivered records that the messages peer sent to reader up to seq
+// reached one of reader's clients and tells peer about it.
+func (h *ConnectionHandler) markDelivered(reader user.User, peer user.User, seq int64) {
+	now := time.Now().UTC()
+	ids, err := h.messageStorage.MarkDeliveredUpTo(reader.Id, peer.Id, seq, now)
+	if err != nil {
+		fmt.Println("error marking message as delivered: ", err)
+		return
+	}
+	if len(ids) > 0 {
+		h.Notify(reader.Username, peer.Username, message.Receipt{Type: message.ReceiptDelivered, MessageIds: ids, At: now})
 	}
 }
@@ -1,36 +1,194 @@
 package connectionManager_test
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/thaironsilva/messenger/api/cognitoClient"
 	"github.com/thaironsilva/messenger/api/connectionManager"
+	"github.com/thaironsilva/messenger/api/resource/attachment"
 	"github.com/thaironsilva/messenger/api/resource/message"
+	"github.com/thaironsilva/messenger/api/resource/ticket"
 	"github.com/thaironsilva/messenger/api/resource/user"
 
 	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
 )
 
 type MockMessageStorage struct {
-	err      error
-	messages []message.Message
+	err         error
+	messages    []message.Message
+	message     message.Message
+	ids         []string
+	undelivered []message.Message
+	seq         atomic.Int64
+	mu          sync.Mutex
+	// cursor is the delivery cursor of the clients without a device,
+	// devices those of the others.
+	cursor  int64
+	devices map[string]int64
+	keys    map[string]message.Message
+	// deliveredUpTo is the highest seq MarkDeliveredUpTo was called with.
+	deliveredUpTo int64
+	// acking, when set, is signaled as AdvanceCursor is called, before it
+	// takes mu.
+	acking chan struct{}
 }
 
 func (m *MockMessageStorage) GetAll(sender_id string, receiver_id string) ([]message.Message, error) {
 	return m.messages, m.err
 }
 
-func (m *MockMessageStorage) Create(message message.Message) error {
+func (m *MockMessageStorage) Create(newMessage message.Message) (message.Message, error) {
+	if newMessage.IdempotencyKey != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if original, ok := m.keys[*newMessage.IdempotencyKey]; ok {
+			return original, message.ErrDuplicateMessage
+		}
+	}
+
+	newMessage.Seq = m.seq.Add(1)
+	newMessage.Id = strconv.FormatInt(newMessage.Seq, 10)
+	if newMessage.IdempotencyKey != nil && m.err == nil {
+		if m.keys == nil {
+			m.keys = make(map[string]message.Message)
+		}
+		m.keys[*newMessage.IdempotencyKey] = newMessage
+	}
+	return newMessage, m.err
+}
+
+func (m *MockMessageStorage) MarkDelivered(receiver_id string, ids []string, at time.Time) ([]string, error) {
+	return m.ids, m.err
+}
+
+func (m *MockMessageStorage) MarkRead(receiver_id string, sender_id string, at time.Time) ([]string, error) {
+	return m.ids, m.err
+}
+
+func (m *MockMessageStorage) GetById(id string) (message.Message, error) {
+	return m.message, m.err
+}
+
+func (m *MockMessageStorage) GetReplies(id string) ([]message.Message, error) {
+	return m.messages, m.err
+}
+
+func (m *MockMessageStorage) AddReaction(message_id string, user_id string, emoji string, at time.Time) (bool, error) {
+	return true, m.err
+}
+
+func (m *MockMessageStorage) RemoveReaction(message_id string, user_id string, emoji string) (bool, error) {
+	return true, m.err
+}
+
+func (m *MockMessageStorage) GetReactions(message_ids []string, user_id string) (map[string][]message.Reaction, error) {
+	return nil, m.err
+}
+
+func (m *MockMessageStorage) Search(user_id string, filter message.SearchFilter) ([]message.SearchResult, error) {
+	return nil, m.err
+}
+
+func (m *MockMessageStorage) GetConversations(user_id string, limit int, offset int) ([]message.Conversation, error) {
+	return nil, m.err
+}
+
+func (m *MockMessageStorage) GetCursor(user_id string, peer_id string, device_id string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if device_id == "" {
+		return m.cursor, m.err
+	}
+	if seq, ok := m.devices[device_id]; ok {
+		return seq, m.err
+	}
+	seq := m.cursor
+	for _, cursor := range m.devices {
+		seq = max(seq, cursor)
+	}
+	return seq, m.err
+}
+
+func (m *MockMessageStorage) AdvanceCursor(user_id string, peer_id string, device_id string, seq int64) error {
+	if m.acking != nil {
+		select {
+		case m.acking <- struct{}{}:
+		default:
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if device_id != "" {
+		if m.devices == nil {
+			m.devices = make(map[string]int64)
+		}
+		m.devices[device_id] = max(m.devices[device_id], seq)
+		return m.err
+	}
+	m.cursor = max(m.cursor, seq)
 	return m.err
 }
 
+func (m *MockMessageStorage) GetUndelivered(user_id string, peer_id string, seq int64, limit int) ([]message.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var messages []message.Message
+	for _, msg := range m.undelivered {
+		if msg.Seq > seq && len(messages) < limit {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, m.err
+}
+
+func (m *MockMessageStorage) MarkDeliveredUpTo(receiver_id string, sender_id string, seq int64, at time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveredUpTo = max(m.deliveredUpTo, seq)
+	return m.ids, m.err
+}
+
+type MockTicketStorage struct {
+	mu      sync.Mutex
+	tickets map[string]ticket.Ticket
+}
+
+func (m *MockTicketStorage) Create(newTicket ticket.Ticket) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tickets == nil {
+		m.tickets = make(map[string]ticket.Ticket)
+	}
+	m.tickets[newTicket.Token] = newTicket
+	return nil
+}
+
+func (m *MockTicketStorage) Redeem(token string, now time.Time) (ticket.Ticket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tickets[token]
+	delete(m.tickets, token)
+	if !ok || !t.ExpiresAt.After(now) {
+		return t, ticket.ErrInvalidTicket
+	}
+	return t, nil
+}
+
 type MockUserStorage struct {
 	err   error
 	user  user.User
@@ -39,20 +197,20 @@ type MockUserStorage struct {
 
 func (m *MockUserStorage) GetByUsername(username string) (user.User, error) {
 	if username == "user1" {
-		return user.User{Username: "user1"}, nil
+		return user.User{Id: "id1", Username: "user1"}, nil
 	}
 	if username == "user2" {
-		return user.User{Username: "user2"}, nil
+		return user.User{Id: "id2", Username: "user2"}, nil
 	}
 	return m.user, m.err
 }
 
 func (m *MockUserStorage) GetByEmail(email string) (user.User, error) {
 	if email == "email1" {
-		return user.User{Username: "user1"}, nil
+		return user.User{Id: "id1", Username: "user1"}, nil
 	}
 	if email == "email2" {
-		return user.User{Username: "user2"}, nil
+		return user.User{Id: "id2", Username: "user2"}, nil
 	}
 	return m.user, m.err
 }
@@ -121,10 +279,63 @@ func (m *MockCognito) DeleteUser(token string) error {
 	return m.err
 }
 
+func dial(t *testing.T, s *httptest.Server, path string, token string) *websocket.Conn {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	ws, _, err := websocket.DefaultDialer.DialContext(context.TODO(), "ws"+strings.TrimPrefix(s.URL, "http")+path, header)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return ws
+}
+
+// readEnvelope reads the next envelope of type want, skipping the session
+// id and the receipts pushed along the way.
+func readEnvelope(t *testing.T, ws *websocket.Conn, want string) map[string]any {
+	for {
+		var e map[string]any
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if err := ws.ReadJSON(&e); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if e["type"] == want {
+			return e
+		}
+		if e["type"] != "session" && e["type"] != message.ReceiptDelivered {
+			t.Fatalf("expected '%s' envelope but got '%v'", want, e)
+		}
+	}
+}
+
+// waitFor polls condition until it holds, for up to a second.
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// stall holds up the writer of ws, a /api/v0/ws socket of user2 that was
+// sent a message of user1, until storage is unlocked: the writer waits for
+// storage as it handles the received frame of ws.
+func stall(t *testing.T, ws *websocket.Conn, storage *MockMessageStorage) {
+	storage.acking = make(chan struct{}, 1)
+	storage.mu.Lock()
+	ws.WriteJSON(map[string]string{"type": "received", "conversation": "user1"})
+	select {
+	case <-storage.acking:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the writer to acknowledge the messages")
+	}
+}
+
 func TestConnectionManager_testHandleConnections(t *testing.T) {
 	t.Run("stabishes_double_sided_connection_and_exchange_messages", func(t *testing.T) {
 		wantCount := 100
-		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockCognito{})
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
 		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
 		defer s.Close()
 
@@ -216,7 +427,7 @@ func TestConnectionManager_testHandleConnections(t *testing.T) {
 
 	t.Run("establishes_one_sided_connection_and_dont_fail", func(t *testing.T) {
 		wantCount := 100
-		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockCognito{})
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
 		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
 		defer s.Close()
 
@@ -252,4 +463,1718 @@ func TestConnectionManager_testHandleConnections(t *testing.T) {
 		}()
 		wg.Wait()
 	})
+
+	t.Run("pushes_read_receipt_to_sender", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{ids: []string{"id"}}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
+		defer s.Close()
+
+		header := http.Header{}
+		header.Set("Authorization", "Bearer token1")
+		ws1, _, err := websocket.DefaultDialer.DialContext(context.TODO(), "ws"+strings.TrimPrefix(s.URL, "http")+"/api/v0/chat/user2", header)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		defer ws1.Close()
+
+		header = http.Header{}
+		header.Set("Authorization", "Bearer token2")
+		ws2, _, err := websocket.DefaultDialer.DialContext(context.TODO(), "ws"+strings.TrimPrefix(s.URL, "http")+"/api/v0/chat/user1", header)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		defer ws2.Close()
+
+		if err := ws2.WriteJSON(map[string]string{"type": "read"}); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		var receipt message.Receipt
+		ws1.SetReadDeadline(time.Now().Add(time.Second))
+		if err := ws1.ReadJSON(&receipt); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if receipt.Type != message.ReceiptRead || len(receipt.MessageIds) != 1 {
+			t.Errorf("expected read receipt for one message but got '%+v'", receipt)
+		}
+	})
+
+	t.Run("relays_typing_frames_to_peer", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
+		defer s.Close()
+
+		header := http.Header{}
+		header.Set("Authorization", "Bearer token1")
+		ws1, _, err := websocket.DefaultDialer.DialContext(context.TODO(), "ws"+strings.TrimPrefix(s.URL, "http")+"/api/v0/chat/user2", header)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		defer ws1.Close()
+
+		header = http.Header{}
+		header.Set("Authorization", "Bearer token2")
+		ws2, _, err := websocket.DefaultDialer.DialContext(context.TODO(), "ws"+strings.TrimPrefix(s.URL, "http")+"/api/v0/chat/user1", header)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		defer ws2.Close()
+
+		for _, frameType := range []string{"typing.start", "typing.start", "typing.stop"} {
+			if err := ws1.WriteJSON(map[string]string{"type": frameType}); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+
+		// the second typing.start falls inside the rate limit and is not relayed
+		for _, want := range []string{"typing.start", "typing.stop"} {
+			var event map[string]string
+			ws2.SetReadDeadline(time.Now().Add(time.Second))
+			if err := ws2.ReadJSON(&event); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if event["type"] != want || event["from"] != "user1" {
+				t.Errorf("expected '%s' from user1 but got '%v'", want, event)
+			}
+		}
+	})
+
+	t.Run("drops_typing_frames_over_the_rate_limit", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
+		defer s.Close()
+
+		ws2 := dial(t, s, "/api/v0/chat/user1", "token2")
+		defer ws2.Close()
+		ws1 := dial(t, s, "/api/v0/chat/user2", "token1")
+		defer ws1.Close()
+
+		for i := 0; i < 10; i++ {
+			ws1.WriteJSON(map[string]string{"type": "typing.start"})
+			ws1.WriteJSON(map[string]string{"type": "typing.stop"})
+		}
+
+		// a burst of 4 frames is let through, then one every 500ms
+		relayed := 0
+		for {
+			var event map[string]string
+			ws2.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			if err := ws2.ReadJSON(&event); err != nil {
+				break
+			}
+			relayed++
+		}
+		if relayed != 4 {
+			t.Errorf("expected '4' typing events but got '%d'", relayed)
+		}
+	})
+
+	t.Run("authenticates_before_looking_up_the_receiver", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{err: errors.New("sql: no rows in result set")}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
+		defer s.Close()
+
+		for _, token := range []string{"", "token1"} {
+			req, _ := http.NewRequest(http.MethodGet, s.URL+"/api/v0/chat/nobody", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			resp.Body.Close()
+
+			want := http.StatusNotFound
+			if token == "" {
+				want = http.StatusBadRequest
+			}
+			if resp.StatusCode != want {
+				t.Errorf("expected '%d' but got '%d'", want, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("replays_undelivered_messages_before_live_ones", func(t *testing.T) {
+		storage := &MockMessageStorage{cursor: 1, undelivered: []message.Message{
+			{Id: "1", Seq: 1, Body: "already delivered"},
+			{Id: "2", Seq: 2, Body: "missed message 1"},
+			{Id: "3", Seq: 3, Body: "missed message 2"},
+		}}
+		storage.seq.Store(3)
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
+		defer s.Close()
+
+		header := http.Header{}
+		header.Set("Authorization", "Bearer token2")
+		ws2, _, err := websocket.DefaultDialer.DialContext(context.TODO(), "ws"+strings.TrimPrefix(s.URL, "http")+"/api/v0/chat/user1", header)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		defer ws2.Close()
+
+		header = http.Header{}
+		header.Set("Authorization", "Bearer token1")
+		ws1, _, err := websocket.DefaultDialer.DialContext(context.TODO(), "ws"+strings.TrimPrefix(s.URL, "http")+"/api/v0/chat/user2", header)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		defer ws1.Close()
+
+		if err := ws1.WriteJSON("live message"); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		for _, want := range []string{"missed message 1", "missed message 2", "live message"} {
+			var receive string
+			ws2.SetReadDeadline(time.Now().Add(time.Second))
+			if err := ws2.ReadJSON(&receive); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if receive != want {
+				t.Errorf("expected '%s' but got '%s'", want, receive)
+			}
+		}
+
+		// clients of bare bodies can't acknowledge, what they are sent is
+		waitFor(t, func() bool {
+			storage.mu.Lock()
+			defer storage.mu.Unlock()
+			return storage.cursor == 4
+		})
+	})
+
+	t.Run("replays_nothing_twice_to_reconnecting_legacy_clients", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "1", Seq: 1, SenderId: "id1", Body: "missed message 1"},
+			{Id: "2", Seq: 2, SenderId: "id1", Body: "missed message 2"},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
+		defer s.Close()
+
+		ws2 := dial(t, s, "/api/v0/chat/user1", "token2")
+		for _, want := range []string{"missed message 1", "missed message 2"} {
+			var receive string
+			ws2.SetReadDeadline(time.Now().Add(time.Second))
+			if err := ws2.ReadJSON(&receive); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if receive != want {
+				t.Errorf("expected '%s' but got '%s'", want, receive)
+			}
+		}
+		waitFor(t, func() bool {
+			storage.mu.Lock()
+			defer storage.mu.Unlock()
+			return storage.cursor == 2
+		})
+		ws2.Close()
+
+		ws2 = dial(t, s, "/api/v0/chat/user1", "token2")
+		defer ws2.Close()
+		// stored too, so it arrives whether or not the replay ran already
+		msg := message.Message{Id: "3", Seq: 3, SenderId: "id1", ReceiverId: "id2", Body: "live message"}
+		storage.mu.Lock()
+		storage.undelivered = append(storage.undelivered, msg)
+		storage.mu.Unlock()
+		connHandler.Deliver("user1", "user2", msg)
+
+		var receive string
+		ws2.SetReadDeadline(time.Now().Add(time.Second))
+		if err := ws2.ReadJSON(&receive); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if receive != "live message" {
+			t.Errorf("expected 'live message' but got '%s'", receive)
+		}
+	})
+
+	t.Run("acks_structured_frames_and_pushes_full_messages", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleConnections))
+		defer s.Close()
+
+		ws2 := dial(t, s, "/api/v0/chat/user1?messages=full", "token2")
+		defer ws2.Close()
+		ws1 := dial(t, s, "/api/v0/chat/user2", "token1")
+		defer ws1.Close()
+
+		if err := ws1.WriteJSON(map[string]string{"type": "message", "clientId": "c1", "body": "hello"}); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		var ack map[string]string
+		ws1.SetReadDeadline(time.Now().Add(time.Second))
+		if err := ws1.ReadJSON(&ack); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if ack["type"] != "ack" || ack["clientId"] != "c1" || ack["id"] != "1" || ack["createdAt"] == "" {
+			t.Errorf("expected ack of 'c1' with id '1' but got '%v'", ack)
+		}
+
+		var receive map[string]any
+		ws2.SetReadDeadline(time.Now().Add(time.Second))
+		if err := ws2.ReadJSON(&receive); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if receive["id"] != "1" || receive["body"] != "hello" || receive["senderId"] != "id1" || receive["createdAt"] == "0001-01-01T00:00:00Z" {
+			t.Errorf("expected message '1' from id1 but got '%v'", receive)
+		}
+
+		if err := ws1.WriteJSON(map[string]string{"type": "message", "clientId": "c2", "body": ""}); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		for {
+			var event map[string]any
+			ws1.SetReadDeadline(time.Now().Add(time.Second))
+			if err := ws1.ReadJSON(&event); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if event["type"] == message.ReceiptDelivered {
+				continue
+			}
+			if event["type"] != "error" || event["clientId"] != "c2" {
+				t.Errorf("expected error for 'c2' but got '%v'", event)
+			}
+			break
+		}
+	})
+}
+
+func TestConnectionManager_testHandleSocket(t *testing.T) {
+	t.Run("exchanges_messages_between_subscribed_sockets", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2", "id": "s1"})
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s2"})
+		if e := readEnvelope(t, ws1, "subscribed"); e["id"] != "s1" || e["conversation"] != "user2" {
+			t.Errorf("expected subscription to user2 but got '%v'", e)
+		}
+		readEnvelope(t, ws2, "subscribed")
+
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "id": "m1", "payload": map[string]string{"body": "hello"}})
+
+		e := readEnvelope(t, ws2, "message")
+		payload, _ := e["payload"].(map[string]any)
+		if e["conversation"] != "user1" || payload["body"] != "hello" {
+			t.Errorf("expected 'hello' from user1 but got '%v'", e)
+		}
+	})
+
+	t.Run("acks_messages_with_their_server_ids", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2", "id": "s1"})
+		readEnvelope(t, ws1, "subscribed")
+
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "id": "m1", "payload": map[string]string{"clientId": "c1", "body": "hello"}})
+
+		e := readEnvelope(t, ws1, "ack")
+		payload, _ := e["payload"].(map[string]any)
+		if e["id"] != "m1" || e["conversation"] != "user2" || payload["clientId"] != "c1" || payload["id"] != "1" || payload["createdAt"] == nil {
+			t.Errorf("expected ack of 'm1' with id '1' but got '%v'", e)
+		}
+	})
+
+	t.Run("advances_the_cursor_only_when_the_client_acknowledges", func(t *testing.T) {
+		storage := &MockMessageStorage{}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		for _, seq := range []int64{1, 2} {
+			connHandler.Deliver("user1", "user2", message.Message{Id: strconv.FormatInt(seq, 10), Seq: seq, SenderId: "id1", ReceiverId: "id2"})
+			readEnvelope(t, ws2, "message")
+		}
+
+		storage.mu.Lock()
+		cursor := storage.cursor
+		storage.mu.Unlock()
+		if cursor != 0 {
+			t.Fatalf("expected no cursor before the client acknowledges but got '%d'", cursor)
+		}
+
+		ws2.WriteJSON(map[string]any{"type": "received", "conversation": "user1", "payload": map[string]int64{"seq": 1}})
+		waitFor(t, func() bool {
+			storage.mu.Lock()
+			defer storage.mu.Unlock()
+			return storage.cursor == 1
+		})
+	})
+
+	t.Run("keeps_a_delivery_cursor_per_device", func(t *testing.T) {
+		storage := &MockMessageStorage{devices: map[string]int64{"laptop": 0}, undelivered: []message.Message{
+			{Id: "1", Seq: 1, SenderId: "id1", ReceiverId: "id2"},
+			{Id: "2", Seq: 2, SenderId: "id1", ReceiverId: "id2"},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		phone := dial(t, s, "/api/v0/ws?device=phone", "token2")
+		defer phone.Close()
+		phone.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s1"})
+		readEnvelope(t, phone, "message")
+		readEnvelope(t, phone, "message")
+		readEnvelope(t, phone, "subscribed")
+		phone.WriteJSON(map[string]string{"type": "received", "conversation": "user1"})
+		waitFor(t, func() bool {
+			storage.mu.Lock()
+			defer storage.mu.Unlock()
+			return storage.devices["phone"] == 2
+		})
+
+		laptop := dial(t, s, "/api/v0/ws?device=laptop", "token2")
+		defer laptop.Close()
+		laptop.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s1"})
+		for _, want := range []string{"1", "2"} {
+			if e := readEnvelope(t, laptop, "message"); e["id"] != want {
+				t.Errorf("expected message '%s' on the laptop but got '%v'", want, e)
+			}
+		}
+	})
+
+	t.Run("pushes_messages_committed_out_of_order", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		for _, seq := range []int64{3, 2} {
+			id := strconv.FormatInt(seq, 10)
+			connHandler.Deliver("user1", "user2", message.Message{Id: id, Seq: seq, SenderId: "id1", ReceiverId: "id2"})
+			if e := readEnvelope(t, ws2, "message"); e["id"] != id {
+				t.Errorf("expected message '%s' but got '%v'", id, e)
+			}
+		}
+	})
+
+	t.Run("pushes_messages_with_signed_attachment_urls", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		thumbnail := "thumbnails/a1"
+		connHandler.Deliver("user1", "user2", message.Message{Id: "1", Seq: 1, SenderId: "id1", ReceiverId: "id2", Attachments: []attachment.Attachment{{Id: "a1", ThumbnailKey: &thumbnail}}})
+
+		e := readEnvelope(t, ws2, "message")
+		payload, _ := e["payload"].(map[string]any)
+		attachments, _ := payload["attachments"].([]any)
+		if len(attachments) != 1 {
+			t.Fatalf("expected 1 attachment but got '%v'", e)
+		}
+		a, _ := attachments[0].(map[string]any)
+		url, _ := a["url"].(string)
+		thumbnailUrl, _ := a["thumbnailUrl"].(string)
+		if !strings.Contains(url, "signature=") || !strings.Contains(thumbnailUrl, "signature=") {
+			t.Errorf("expected signed urls but got '%v'", a)
+		}
+	})
+
+	t.Run("skips_live_copies_of_replayed_messages", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "1", Seq: 1, SenderId: "id1", ReceiverId: "id2"},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s1"})
+		readEnvelope(t, ws2, "message")
+		readEnvelope(t, ws2, "subscribed")
+
+		for _, seq := range []int64{1, 2} {
+			connHandler.Deliver("user1", "user2", message.Message{Id: strconv.FormatInt(seq, 10), Seq: seq, SenderId: "id1", ReceiverId: "id2"})
+		}
+		if e := readEnvelope(t, ws2, "message"); e["id"] != "2" {
+			t.Errorf("expected message '2' only but got '%v'", e)
+		}
+	})
+
+	t.Run("rejects_devices_too_long", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v0/ws?device="+strings.Repeat("a", 65), nil)
+		req.Header.Set("Authorization", "Bearer token2")
+		rr := httptest.NewRecorder()
+		connHandler.HandleSocket(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected '%d' but got '%d'", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("acks_messages_sent_again_without_delivering_them_twice", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2", "id": "s1"})
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s2"})
+		readEnvelope(t, ws1, "subscribed")
+		readEnvelope(t, ws2, "subscribed")
+
+		for _, id := range []string{"m1", "m2"} {
+			ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "id": id, "payload": map[string]string{"idempotencyKey": "k1", "body": "hello"}})
+			e := readEnvelope(t, ws1, "ack")
+			payload, _ := e["payload"].(map[string]any)
+			if e["id"] != id || payload["id"] != "1" {
+				t.Errorf("expected ack of '%s' with id '1' but got '%v'", id, e)
+			}
+		}
+
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "id": "m3", "payload": map[string]string{"body": "bye"}})
+
+		for _, want := range []string{"hello", "bye"} {
+			e := readEnvelope(t, ws2, "message")
+			payload, _ := e["payload"].(map[string]any)
+			if payload["body"] != want {
+				t.Errorf("expected '%s' but got '%v'", want, e)
+			}
+		}
+	})
+
+	t.Run("delivers_messages_sent_without_a_socket", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2", "id": "s1"})
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1", "id": "s2"})
+		readEnvelope(t, ws1, "subscribed")
+		readEnvelope(t, ws2, "subscribed")
+
+		connHandler.Deliver("user1", "user2", message.Message{Id: "1", Seq: 1, SenderId: "id1", ReceiverId: "id2", Body: "hello"})
+
+		// the sender's own devices get the message too
+		for _, ws := range []*websocket.Conn{ws2, ws1} {
+			e := readEnvelope(t, ws, "message")
+			payload, _ := e["payload"].(map[string]any)
+			if e["id"] != "1" || payload["body"] != "hello" {
+				t.Errorf("expected message '1' but got '%v'", e)
+			}
+		}
+	})
+
+	t.Run("rejects_frames_for_conversations_not_subscribed", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws := dial(t, s, "/api/v0/ws", "token1")
+		defer ws.Close()
+
+		ws.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "id": "m1", "payload": map[string]string{"body": "hello"}})
+
+		if e := readEnvelope(t, ws, "error"); e["id"] != "m1" {
+			t.Errorf("expected error for 'm1' but got '%v'", e)
+		}
+	})
+
+	t.Run("stops_delivering_after_unsubscribe", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+		readEnvelope(t, ws1, "subscribed")
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1"})
+		readEnvelope(t, ws2, "subscribed")
+		ws2.WriteJSON(map[string]string{"type": "unsubscribe", "conversation": "user1"})
+		readEnvelope(t, ws2, "unsubscribed")
+
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "hello"}})
+
+		var e map[string]any
+		ws2.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if err := ws2.ReadJSON(&e); err == nil {
+			t.Errorf("expected nothing but got '%v'", e)
+		}
+	})
+
+	t.Run("interoperates_with_the_per_conversation_socket", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v0/chat/{username}", connHandler.HandleConnections)
+		mux.HandleFunc("/api/v0/ws", connHandler.HandleSocket)
+		s := httptest.NewServer(mux)
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/chat/user2", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		ws1.WriteJSON("from the old socket")
+		e := readEnvelope(t, ws2, "message")
+		if payload, _ := e["payload"].(map[string]any); payload["body"] != "from the old socket" {
+			t.Errorf("expected 'from the old socket' but got '%v'", e)
+		}
+
+		ws2.WriteJSON(map[string]any{"type": "message", "conversation": "user1", "payload": map[string]string{"body": "from the new socket"}})
+		var receive string
+		ws1.SetReadDeadline(time.Now().Add(time.Second))
+		if err := ws1.ReadJSON(&receive); err != nil || receive != "from the new socket" {
+			t.Errorf("expected 'from the new socket' but got '%s', %v", receive, err)
+		}
+	})
+
+	t.Run("fans_out_messages_to_every_device", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		phone1 := dial(t, s, "/api/v0/ws", "token1")
+		defer phone1.Close()
+		laptop1 := dial(t, s, "/api/v0/ws", "token1")
+		defer laptop1.Close()
+		phone2 := dial(t, s, "/api/v0/ws", "token2")
+		defer phone2.Close()
+		laptop2 := dial(t, s, "/api/v0/ws", "token2")
+		defer laptop2.Close()
+
+		ids := make(map[string]bool)
+		for _, ws := range []*websocket.Conn{phone1, laptop1, phone2, laptop2} {
+			e := readEnvelope(t, ws, "session")
+			payload, _ := e["payload"].(map[string]any)
+			ids[payload["id"].(string)] = true
+		}
+		if len(ids) != 4 {
+			t.Errorf("expected '4' session ids but got '%d'", len(ids))
+		}
+
+		for _, ws := range []*websocket.Conn{phone1, laptop1} {
+			ws.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+			readEnvelope(t, ws, "subscribed")
+		}
+		for _, ws := range []*websocket.Conn{phone2, laptop2} {
+			ws.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1"})
+			readEnvelope(t, ws, "subscribed")
+		}
+
+		phone1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "hello"}})
+
+		for name, ws := range map[string]*websocket.Conn{"laptop1": laptop1, "phone2": phone2, "laptop2": laptop2} {
+			e := readEnvelope(t, ws, "message")
+			if payload, _ := e["payload"].(map[string]any); payload["body"] != "hello" {
+				t.Errorf("expected 'hello' on %s but got '%v'", name, e)
+			}
+		}
+
+		// closing a device leaves the others connected
+		laptop2.Close()
+		phone1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "still there?"}})
+		e := readEnvelope(t, phone2, "message")
+		if payload, _ := e["payload"].(map[string]any); payload["body"] != "still there?" {
+			t.Errorf("expected 'still there?' but got '%v'", e)
+		}
+	})
+
+	t.Run("delivers_across_instances_sharing_a_broker", func(t *testing.T) {
+		broker := connectionManager.NewMemoryBroker()
+		instance1 := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, broker)
+		instance2 := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, broker)
+		s1 := httptest.NewServer(http.HandlerFunc(instance1.HandleSocket))
+		defer s1.Close()
+		s2 := httptest.NewServer(http.HandlerFunc(instance2.HandleSocket))
+		defer s2.Close()
+
+		ws1 := dial(t, s1, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s2, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+		readEnvelope(t, ws1, "subscribed")
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "hello"}})
+		e := readEnvelope(t, ws2, "message")
+		if payload, _ := e["payload"].(map[string]any); payload["body"] != "hello" {
+			t.Errorf("expected 'hello' but got '%v'", e)
+		}
+
+		ws2.WriteJSON(map[string]string{"type": "typing.start", "conversation": "user1"})
+		if e := readEnvelope(t, ws1, "typing.start"); e["conversation"] != "user2" {
+			t.Errorf("expected typing from user2 but got '%v'", e)
+		}
+	})
+
+	t.Run("evicts_clients_that_miss_heartbeats", func(t *testing.T) {
+		t.Setenv("WS_PING_INTERVAL", "20ms")
+		t.Setenv("WS_PONG_TIMEOUT", "100ms")
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws := dial(t, s, "/api/v0/ws", "token1")
+		defer ws.Close()
+		// a half-open client never answers pings
+		ws.SetPingHandler(func(string) error { return nil })
+
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			var e map[string]any
+			err := ws.ReadJSON(&e)
+			if err == nil {
+				continue
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatalf("expected the server to close the socket but got '%v'", err)
+			}
+			break
+		}
+	})
+
+	t.Run("keeps_clients_answering_heartbeats", func(t *testing.T) {
+		t.Setenv("WS_PING_INTERVAL", "20ms")
+		t.Setenv("WS_PONG_TIMEOUT", "100ms")
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws := dial(t, s, "/api/v0/ws", "token1")
+		defer ws.Close()
+
+		// reading answers the pings
+		envelopes := make(chan map[string]any, 16)
+		go func() {
+			defer close(envelopes)
+			for {
+				var e map[string]any
+				if err := ws.ReadJSON(&e); err != nil {
+					return
+				}
+				envelopes <- e
+			}
+		}()
+
+		time.Sleep(300 * time.Millisecond)
+		ws.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case e, ok := <-envelopes:
+				if !ok {
+					t.Fatalf("expected the socket to stay open")
+				}
+				if e["type"] == "subscribed" {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("expected 'subscribed' envelope")
+			}
+		}
+	})
+
+	t.Run("closes_sockets_sending_oversized_frames", func(t *testing.T) {
+		t.Setenv("WS_MAX_MESSAGE_BYTES", "1024")
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws := dial(t, s, "/api/v0/ws", "token1")
+		defer ws.Close()
+
+		ws.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": strings.Repeat("a", 2048)}})
+
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			var e map[string]any
+			err := ws.ReadJSON(&e)
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("expected close code %d but got '%v'", websocket.CloseMessageTooBig, err)
+			}
+			break
+		}
+	})
+
+	t.Run("replays_messages_dropped_for_slow_clients", func(t *testing.T) {
+		t.Setenv("WS_QUEUE_SIZE", "1")
+		storage := &MockMessageStorage{}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+		readEnvelope(t, ws1, "subscribed")
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m1"}})
+		readEnvelope(t, ws2, "message")
+
+		stall(t, ws2, storage)
+		storage.undelivered = []message.Message{{Seq: 1, Body: "m1"}, {Seq: 2, Body: "m2"}, {Seq: 3, Body: "m3"}}
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m2"}})
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m3"}})
+		ws1.WriteJSON(map[string]string{"type": "typing.start", "conversation": "user2"})
+		waitFor(t, func() bool { return connHandler.Stats().Dropped == 2 })
+		storage.mu.Unlock()
+
+		for _, want := range []string{"m2", "m3"} {
+			e := readEnvelope(t, ws2, "message")
+			if payload, _ := e["payload"].(map[string]any); payload["body"] != want {
+				t.Errorf("expected '%s' but got '%v'", want, e)
+			}
+		}
+
+		e := readEnvelope(t, ws2, "overflow")
+		if payload, _ := e["payload"].(map[string]any); payload["dropped"] != float64(1) {
+			t.Errorf("expected 1 dropped event but got '%v'", e)
+		}
+	})
+
+	t.Run("disconnects_slow_clients", func(t *testing.T) {
+		t.Setenv("WS_QUEUE_SIZE", "1")
+		t.Setenv("WS_OVERFLOW_POLICY", "disconnect")
+		storage := &MockMessageStorage{}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+		readEnvelope(t, ws1, "subscribed")
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m1"}})
+		readEnvelope(t, ws2, "message")
+
+		stall(t, ws2, storage)
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m2"}})
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m3"}})
+		waitFor(t, func() bool { return connHandler.Stats().Disconnected == 1 })
+		storage.mu.Unlock()
+
+		ws2.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			var e map[string]any
+			err := ws2.ReadJSON(&e)
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("expected close code %d but got '%v'", websocket.ClosePolicyViolation, err)
+			}
+			break
+		}
+	})
+
+	t.Run("flushes_queued_messages_and_closes_on_shutdown", func(t *testing.T) {
+		storage := &MockMessageStorage{}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		ws1 := dial(t, s, "/api/v0/ws", "token1")
+		defer ws1.Close()
+		ws2 := dial(t, s, "/api/v0/ws", "token2")
+		defer ws2.Close()
+
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+		readEnvelope(t, ws1, "subscribed")
+		ws2.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user1"})
+		readEnvelope(t, ws2, "subscribed")
+
+		// the writer of ws2 stalls after the first message, so the second
+		// is still queued when the shutdown starts
+		storage.mu.Lock()
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m1"}})
+		ws1.WriteJSON(map[string]any{"type": "message", "conversation": "user2", "payload": map[string]string{"body": "m2"}})
+		ws1.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+		readEnvelope(t, ws1, "subscribed")
+
+		shutdown := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			shutdown <- connHandler.Shutdown(ctx)
+		}()
+		storage.mu.Unlock()
+
+		for _, want := range []string{"m1", "m2"} {
+			e := readEnvelope(t, ws2, "message")
+			if payload, _ := e["payload"].(map[string]any); payload["body"] != want {
+				t.Errorf("expected '%s' but got '%v'", want, e)
+			}
+		}
+
+		for _, ws := range []*websocket.Conn{ws1, ws2} {
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				var e map[string]any
+				err := ws.ReadJSON(&e)
+				if err == nil {
+					continue
+				}
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+					t.Errorf("expected close code %d but got '%v'", websocket.CloseGoingAway, err)
+				}
+				break
+			}
+		}
+
+		if err := <-shutdown; err != nil {
+			t.Errorf("expected no error but got '%v'", err)
+		}
+		waitFor(t, func() bool { return connHandler.Stats().Sessions == 0 })
+	})
+
+	t.Run("gives_up_on_clients_that_dont_close_on_shutdown", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+		defer s.Close()
+
+		// a client that doesn't read never answers the close frame
+		ws := dial(t, s, "/api/v0/ws", "token1")
+		defer ws.Close()
+		waitFor(t, func() bool { return connHandler.Stats().Sessions == 1 })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := connHandler.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected '%v' but got '%v'", context.DeadlineExceeded, err)
+		}
+		waitFor(t, func() bool { return connHandler.Stats().Sessions == 0 })
+	})
+}
+
+// openStream opens an /api/v0/events stream as the user of token, resuming
+// from lastEventId unless it is empty. Closing its body ends the stream.
+func openStream(t *testing.T, s *httptest.Server, query string, token string, lastEventId string) *http.Response {
+	ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/api/v0/events"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return resp
+}
+
+// readEvent reads the next event of a stream, skipping comments, and
+// returns its id and its envelope.
+func readEvent(t *testing.T, stream *bufio.Reader) (string, map[string]any) {
+	var id, data string
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && data != "":
+			var e map[string]any
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatalf("%v", err)
+			}
+			return id, e
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestConnectionManager_testHandleEvents(t *testing.T) {
+	t.Run("streams_envelopes_of_the_conversations_asked_for", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleEvents))
+		defer s.Close()
+
+		resp := openStream(t, s, "?conversation=user1", "token2", "")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected an event stream but got '%d' '%s'", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		stream := bufio.NewReader(resp.Body)
+
+		if _, e := readEvent(t, stream); e["type"] != "session" {
+			t.Errorf("expected 'session' envelope but got '%v'", e)
+		}
+
+		waitFor(t, func() bool { return connHandler.Stats().Sessions == 1 })
+		connHandler.Deliver("user1", "user2", message.Message{Id: "m1", Seq: 1, SenderId: "id1", ReceiverId: "id2", Body: "hello"})
+
+		id, e := readEvent(t, stream)
+		payload, _ := e["payload"].(map[string]any)
+		if id != "1" || e["type"] != "message" || e["conversation"] != "user1" || payload["body"] != "hello" {
+			t.Errorf("expected message '1' from user1 but got '%s' '%v'", id, e)
+		}
+	})
+
+	t.Run("resumes_from_the_last_event_id", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "m1", Seq: 1, SenderId: "id1", Body: "received"},
+			{Id: "m2", Seq: 2, SenderId: "id1", Body: "lost 1"},
+			{Id: "m3", Seq: 3, SenderId: "id1", Body: "lost 2"},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleEvents))
+		defer s.Close()
+
+		resp := openStream(t, s, "?conversation=user1", "token2", "1")
+		defer resp.Body.Close()
+		stream := bufio.NewReader(resp.Body)
+		readEvent(t, stream)
+
+		for _, want := range []string{"lost 1", "lost 2"} {
+			_, e := readEvent(t, stream)
+			payload, _ := e["payload"].(map[string]any)
+			if payload["body"] != want {
+				t.Errorf("expected '%s' but got '%v'", want, e)
+			}
+		}
+
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		if storage.cursor != 1 {
+			t.Errorf("expected the last event id to be acknowledged but got cursor '%d'", storage.cursor)
+		}
+	})
+
+	t.Run("has_no_event_ids_until_every_conversation_is_replayed", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "m1", Seq: 1, SenderId: "id1", Body: "missed"},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{user: user.User{Id: "id3", Username: "user3"}}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleEvents))
+		defer s.Close()
+
+		resp := openStream(t, s, "?conversation=user1&conversation=user3", "token2", "")
+		defer resp.Body.Close()
+		stream := bufio.NewReader(resp.Body)
+		readEvent(t, stream)
+
+		for _, conversation := range []string{"user1", "user3"} {
+			id, e := readEvent(t, stream)
+			if id != "" || e["conversation"] != conversation {
+				t.Errorf("expected the replay of '%s' without id but got '%s' '%v'", conversation, id, e)
+			}
+		}
+
+		connHandler.Deliver("user1", "user2", message.Message{Id: "m2", Seq: 2, SenderId: "id1", ReceiverId: "id2", Body: "live"})
+		if id, e := readEvent(t, stream); id != "1" {
+			t.Errorf("expected id '1' but got '%s' '%v'", id, e)
+		}
+	})
+
+	t.Run("ends_streams_on_shutdown", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleEvents))
+		defer s.Close()
+
+		resp := openStream(t, s, "?conversation=user1", "token2", "")
+		defer resp.Body.Close()
+		stream := bufio.NewReader(resp.Body)
+		readEvent(t, stream)
+
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+		defer cancel()
+		if err := connHandler.Shutdown(ctx); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if _, err := io.ReadAll(stream); err != nil {
+			t.Errorf("expected the stream to end but got '%v'", err)
+		}
+	})
+
+	t.Run("rejects_invalid_streams", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{err: errors.New("sql: no rows in result set")}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandleEvents))
+		defer s.Close()
+
+		tests := []struct {
+			name           string
+			query          string
+			lastEventId    string
+			wantStatusCode int
+		}{
+			{name: "without_conversation", query: "", wantStatusCode: http.StatusBadRequest},
+			{name: "with_invalid_last_event_id", query: "?conversation=user1", lastEventId: "abc", wantStatusCode: http.StatusBadRequest},
+			{name: "with_unknown_conversation", query: "?conversation=nobody", wantStatusCode: http.StatusNotFound},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				resp := openStream(t, s, tt.query, "token2", tt.lastEventId)
+				defer resp.Body.Close()
+				if resp.StatusCode != tt.wantStatusCode {
+					t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, resp.StatusCode)
+				}
+			})
+		}
+	})
+}
+
+func TestConnectionManager_testHandleReceived(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		userErr        error
+		wantStatusCode int
+		wantCursor     int64
+	}{
+		{name: "acknowledges_messages_up_to_seq", body: `{"conversation":"user1","seq":3}`, wantStatusCode: http.StatusNoContent, wantCursor: 3},
+		{name: "without_seq", body: `{"conversation":"user1"}`, wantStatusCode: http.StatusBadRequest},
+		{name: "without_conversation", body: `{"seq":3}`, wantStatusCode: http.StatusBadRequest},
+		{name: "with_invalid_body", body: `{`, wantStatusCode: http.StatusBadRequest},
+		{name: "with_unknown_conversation", body: `{"conversation":"nobody","seq":3}`, userErr: errors.New("sql: no rows in result set"), wantStatusCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &MockMessageStorage{}
+			connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{err: tt.userErr}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v0/events/received", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer token2")
+			rr := httptest.NewRecorder()
+			connHandler.HandleReceived(rr, req)
+
+			if rr.Code != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, rr.Code)
+			}
+			if storage.cursor != tt.wantCursor {
+				t.Errorf("expected cursor '%d' but got '%d'", tt.wantCursor, storage.cursor)
+			}
+		})
+	}
+}
+
+// poll runs a long poll as the user of token and decodes its answer.
+func poll(t *testing.T, s *httptest.Server, query string, token string) (int, map[string]any) {
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/api/v0/poll"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("%v", err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestConnectionManager_testHandlePoll(t *testing.T) {
+	t.Run("answers_at_once_with_the_messages_after_the_cursor", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "m1", Seq: 1, SenderId: "id1", Body: "polled"},
+			{Id: "m2", Seq: 2, SenderId: "id1", Body: "missed 1"},
+			{Id: "m3", Seq: 3, SenderId: "id1", Body: "missed 2"},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		status, body := poll(t, s, "?conversation=user1&cursor=1", "token2")
+		messages, _ := body["messages"].([]any)
+		if status != http.StatusOK || len(messages) != 2 || body["cursor"] != float64(3) {
+			t.Errorf("expected 2 messages up to cursor '3' but got '%d' '%v'", status, body)
+		}
+
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		if storage.cursor != 0 {
+			t.Errorf("expected the delivery cursor of the sockets to stay '0' but got '%d'", storage.cursor)
+		}
+	})
+
+	t.Run("acknowledges_no_further_than_it_returned", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "m1", Seq: 1, SenderId: "id1"},
+			{Id: "m2", Seq: 2, SenderId: "id1"},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		if status, body := poll(t, s, "?conversation=user1&cursor=9223372036854775807&timeout=1", "token2"); status != http.StatusOK {
+			t.Fatalf("expected '200' but got '%d' '%v'", status, body)
+		}
+		storage.mu.Lock()
+		if storage.deliveredUpTo != 0 {
+			t.Errorf("expected nothing delivered before a poll returned it but got '%d'", storage.deliveredUpTo)
+		}
+		storage.mu.Unlock()
+
+		poll(t, s, "?conversation=user1&cursor=0", "token2")
+		poll(t, s, "?conversation=user1&cursor=9223372036854775807&timeout=1", "token2")
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		if storage.deliveredUpTo != 2 {
+			t.Errorf("expected messages delivered up to '2' but got '%d'", storage.deliveredUpTo)
+		}
+	})
+
+	t.Run("holds_back_messages_just_created", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "m1", Seq: 1, SenderId: "id1", CreatedAt: time.Now()},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		start := time.Now()
+		status, body := poll(t, s, "?conversation=user1&cursor=0&timeout=10", "token2")
+		messages, _ := body["messages"].([]any)
+		if status != http.StatusOK || len(messages) != 1 {
+			t.Errorf("expected message 'm1' but got '%d' '%v'", status, body)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 5*time.Second {
+			t.Errorf("expected the message held back for a moment but got it after '%v'", elapsed)
+		}
+	})
+
+	t.Run("answers_with_signed_attachment_urls", func(t *testing.T) {
+		storage := &MockMessageStorage{undelivered: []message.Message{
+			{Id: "m1", Seq: 1, SenderId: "id1", Attachments: []attachment.Attachment{{Id: "a1"}}},
+		}}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		_, body := poll(t, s, "?conversation=user1&cursor=0", "token2")
+		messages, _ := body["messages"].([]any)
+		if len(messages) != 1 {
+			t.Fatalf("expected message 'm1' but got '%v'", body)
+		}
+		m, _ := messages[0].(map[string]any)
+		attachments, _ := m["attachments"].([]any)
+		a, _ := attachments[0].(map[string]any)
+		if url, _ := a["url"].(string); !strings.Contains(url, "signature=") {
+			t.Errorf("expected a signed url but got '%v'", a)
+		}
+	})
+
+	t.Run("wakes_when_a_message_arrives", func(t *testing.T) {
+		storage := &MockMessageStorage{}
+		connHandler := connectionManager.NewConnectionHandler(storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		type answer struct {
+			status int
+			body   map[string]any
+		}
+		answers := make(chan answer, 1)
+		start := time.Now()
+		go func() {
+			status, body := poll(t, s, "?conversation=user1&cursor=0&timeout=10", "token2")
+			answers <- answer{status, body}
+		}()
+
+		waitFor(t, func() bool { return connHandler.Stats().Polls == 1 })
+
+		msg := message.Message{Id: "m1", Seq: 1, SenderId: "id1", ReceiverId: "id2", Body: "hello"}
+		storage.mu.Lock()
+		storage.undelivered = append(storage.undelivered, msg)
+		storage.mu.Unlock()
+		connHandler.Deliver("user1", "user2", msg)
+
+		select {
+		case a := <-answers:
+			messages, _ := a.body["messages"].([]any)
+			if a.status != http.StatusOK || len(messages) != 1 || a.body["cursor"] != float64(1) {
+				t.Errorf("expected message 'm1' at cursor '1' but got '%d' '%v'", a.status, a.body)
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("expected the poll to wake up before its timeout")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the poll to wake up before its timeout")
+		}
+	})
+
+	t.Run("answers_with_the_same_cursor_once_it_times_out", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		start := time.Now()
+		status, body := poll(t, s, "?conversation=user1&cursor=5&timeout=1", "token2")
+		messages, _ := body["messages"].([]any)
+		if status != http.StatusOK || len(messages) != 0 || body["cursor"] != float64(5) {
+			t.Errorf("expected no messages at cursor '5' but got '%d' '%v'", status, body)
+		}
+		if time.Since(start) < time.Second {
+			t.Errorf("expected the poll to wait for its timeout")
+		}
+	})
+
+	t.Run("answers_at_once_on_shutdown", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		statuses := make(chan int, 1)
+		go func() {
+			status, _ := poll(t, s, "?conversation=user1&cursor=0&timeout=10", "token2")
+			statuses <- status
+		}()
+
+		waitFor(t, func() bool { return connHandler.Stats().Polls == 1 })
+		connHandler.Shutdown(context.TODO())
+
+		select {
+		case status := <-statuses:
+			if status != http.StatusOK {
+				t.Errorf("expected '200' but got '%d'", status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the poll to answer on shutdown")
+		}
+	})
+
+	t.Run("rejects_invalid_polls", func(t *testing.T) {
+		connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{err: errors.New("sql: no rows in result set")}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+		s := httptest.NewServer(http.HandlerFunc(connHandler.HandlePoll))
+		defer s.Close()
+
+		tests := []struct {
+			name           string
+			query          string
+			wantStatusCode int
+		}{
+			{name: "without_conversation", query: "", wantStatusCode: http.StatusBadRequest},
+			{name: "without_cursor", query: "?conversation=user1", wantStatusCode: http.StatusBadRequest},
+			{name: "with_invalid_cursor", query: "?conversation=user1&cursor=abc", wantStatusCode: http.StatusBadRequest},
+			{name: "with_too_long_timeout", query: "?conversation=user1&cursor=0&timeout=61", wantStatusCode: http.StatusBadRequest},
+			{name: "with_unknown_conversation", query: "?conversation=nobody&cursor=0", wantStatusCode: http.StatusNotFound},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if status, _ := poll(t, s, tt.query, "token2"); status != tt.wantStatusCode {
+					t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, status)
+				}
+			})
+		}
+	})
+}
+
+func TestConnectionManager_testTickets(t *testing.T) {
+	peer := "id2"
+	expiresAt := time.Now().Add(time.Minute)
+	tickets := &MockTicketStorage{}
+	tickets.Create(ticket.Ticket{Token: "query", User: user.User{Id: "id1", Username: "user1"}, ExpiresAt: expiresAt})
+	tickets.Create(ticket.Ticket{Token: "protocol", User: user.User{Id: "id1", Username: "user1"}, ExpiresAt: expiresAt})
+	tickets.Create(ticket.Ticket{Token: "conversation", User: user.User{Id: "id1", Username: "user1"}, PeerId: &peer, ExpiresAt: expiresAt})
+	tickets.Create(ticket.Ticket{Token: "other", User: user.User{Id: "id1", Username: "user1"}, PeerId: &peer, ExpiresAt: expiresAt})
+	tickets.Create(ticket.Ticket{Token: "expired", User: user.User{Id: "id1", Username: "user1"}, ExpiresAt: time.Now().Add(-time.Second)})
+
+	connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, tickets, &MockCognito{}, connectionManager.NewMemoryBroker())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/chat/{username}", connHandler.HandleConnections)
+	mux.HandleFunc("/api/v0/ws", connHandler.HandleSocket)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		path      string
+		protocols []string
+		want      bool
+	}{
+		{name: "accepts_ticket_as_query_parameter", path: "/api/v0/ws?ticket=query", want: true},
+		{name: "rejects_used_ticket", path: "/api/v0/ws?ticket=query", want: false},
+		{name: "accepts_ticket_as_protocol", path: "/api/v0/ws", protocols: []string{"ticket.protocol"}, want: true},
+		{name: "accepts_ticket_for_its_conversation", path: "/api/v0/chat/user2?ticket=conversation", want: true},
+		{name: "rejects_ticket_for_other_conversation", path: "/api/v0/chat/user1?ticket=other", want: false},
+		{name: "rejects_expired_ticket", path: "/api/v0/ws?ticket=expired", want: false},
+		{name: "rejects_unknown_ticket", path: "/api/v0/ws?ticket=unknown", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: tt.protocols}
+			ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+tt.path, nil)
+			if err != nil {
+				if tt.want {
+					t.Fatalf("%v", err)
+				}
+				return
+			}
+			defer ws.Close()
+
+			if len(tt.protocols) > 0 && ws.Subprotocol() != tt.protocols[0] {
+				t.Errorf("expected protocol '%s' but got '%s'", tt.protocols[0], ws.Subprotocol())
+			}
+
+			// an open session answers frames, with an error if need be
+			if strings.HasPrefix(tt.path, "/api/v0/chat/") {
+				ws.WriteJSON(map[string]string{"type": "message", "body": "hello", "format": "unknown"})
+			} else {
+				ws.WriteJSON(map[string]string{"type": "subscribe", "conversation": "user2"})
+			}
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			var e any
+			if got := ws.ReadJSON(&e) == nil; got != tt.want {
+				t.Errorf("expected session %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConnectionManager_testHandshake(t *testing.T) {
+	peer := "id2"
+	notFound := errors.New("sql: no rows in result set")
+
+	tests := []struct {
+		name           string
+		userStorage    *MockUserStorage
+		cognito        *MockCognito
+		path           string
+		token          string
+		wantStatusCode int
+		wantMessage    string
+	}{
+		{
+			name:           "returns_400_without_token",
+			userStorage:    &MockUserStorage{},
+			cognito:        &MockCognito{},
+			path:           "/api/v0/ws",
+			wantStatusCode: http.StatusBadRequest,
+			wantMessage:    "bad request",
+		},
+		{
+			name:           "returns_401_with_invalid_token",
+			userStorage:    &MockUserStorage{},
+			cognito:        &MockCognito{err: errors.New("NotAuthorizedException: Could not verify signature for Access Token")},
+			path:           "/api/v0/ws",
+			token:          "invalid",
+			wantStatusCode: http.StatusUnauthorized,
+			wantMessage:    "unauthorized token",
+		},
+		{
+			name:           "returns_404_when_token_user_is_not_found",
+			userStorage:    &MockUserStorage{err: notFound},
+			cognito:        &MockCognito{},
+			path:           "/api/v0/ws",
+			token:          "unknown",
+			wantStatusCode: http.StatusNotFound,
+			wantMessage:    "user not found",
+		},
+		{
+			name:           "returns_404_when_receiver_is_not_found",
+			userStorage:    &MockUserStorage{err: notFound},
+			cognito:        &MockCognito{},
+			path:           "/api/v0/chat/nobody",
+			token:          "token1",
+			wantStatusCode: http.StatusNotFound,
+			wantMessage:    "user not found",
+		},
+		{
+			name:           "returns_401_with_invalid_ticket",
+			userStorage:    &MockUserStorage{},
+			cognito:        &MockCognito{},
+			path:           "/api/v0/ws?ticket=unknown",
+			wantStatusCode: http.StatusUnauthorized,
+			wantMessage:    "invalid or expired ticket",
+		},
+		{
+			name:           "returns_403_with_ticket_of_other_conversation",
+			userStorage:    &MockUserStorage{},
+			cognito:        &MockCognito{},
+			path:           "/api/v0/ws?ticket=conversation",
+			wantStatusCode: http.StatusForbidden,
+			wantMessage:    "ticket not valid for this conversation",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tickets := &MockTicketStorage{}
+			tickets.Create(ticket.Ticket{Token: "conversation", User: user.User{Id: "id1", Username: "user1"}, PeerId: &peer, ExpiresAt: time.Now().Add(time.Minute)})
+
+			connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, tt.userStorage, tickets, tt.cognito, connectionManager.NewMemoryBroker())
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v0/chat/{username}", connHandler.HandleConnections)
+			mux.HandleFunc("/api/v0/ws", connHandler.HandleSocket)
+			s := httptest.NewServer(mux)
+			defer s.Close()
+
+			header := http.Header{}
+			if tt.token != "" {
+				header.Set("Authorization", "Bearer "+tt.token)
+			}
+			ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+tt.path, header)
+			if err == nil {
+				ws.Close()
+				t.Fatalf("expected the upgrade to fail")
+			}
+
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, resp.StatusCode)
+			}
+			var body map[string]string
+			json.NewDecoder(resp.Body).Decode(&body)
+			if body["message"] != tt.wantMessage {
+				t.Errorf("expected message '%s' but got '%v'", tt.wantMessage, body)
+			}
+		})
+	}
+}
+
+func TestConnectionManager_testCloseCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		storage  *MockMessageStorage
+		path     string
+		frame    string
+		wantCode int
+	}{
+		{
+			name:     "closes_with_1007_on_malformed_chat_frame",
+			storage:  &MockMessageStorage{},
+			path:     "/api/v0/chat/user2",
+			frame:    `{"type":`,
+			wantCode: websocket.CloseInvalidFramePayloadData,
+		},
+		{
+			name:     "closes_with_1007_on_malformed_envelope",
+			storage:  &MockMessageStorage{},
+			path:     "/api/v0/ws",
+			frame:    `{"type": 5}`,
+			wantCode: websocket.CloseInvalidFramePayloadData,
+		},
+		{
+			name:     "closes_with_1011_when_storage_misbehaves",
+			storage:  &MockMessageStorage{err: errors.New("something's wrong")},
+			path:     "/api/v0/chat/user2",
+			frame:    `"hello"`,
+			wantCode: websocket.CloseInternalServerErr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connHandler := connectionManager.NewConnectionHandler(tt.storage, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v0/chat/{username}", connHandler.HandleConnections)
+			mux.HandleFunc("/api/v0/ws", connHandler.HandleSocket)
+			s := httptest.NewServer(mux)
+			defer s.Close()
+
+			ws := dial(t, s, tt.path, "token1")
+			defer ws.Close()
+
+			ws.WriteMessage(websocket.TextMessage, []byte(tt.frame))
+
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				var e any
+				err := ws.ReadJSON(&e)
+				if err == nil {
+					continue
+				}
+				if !websocket.IsCloseError(err, tt.wantCode) {
+					t.Errorf("expected close code %d but got '%v'", tt.wantCode, err)
+				}
+				break
+			}
+		})
+	}
+}
+
+func TestConnectionManager_testCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		devMode string
+		origin  string
+		want    bool
+	}{
+		{name: "allows_clients_sending_no_origin", origin: "", want: true},
+		{name: "allows_listed_origin", origin: "https://app.example.com", want: true},
+		{name: "matches_origins_case_insensitively", origin: "HTTPS://App.Example.com", want: true},
+		{name: "allows_subdomains_of_wildcard", origin: "https://chat.eu.example.org", want: true},
+		{name: "rejects_domain_of_wildcard_itself", origin: "https://example.org", want: false},
+		{name: "rejects_other_scheme", origin: "http://app.example.com", want: false},
+		{name: "rejects_other_port", origin: "https://app.example.com:8443", want: false},
+		{name: "rejects_unlisted_origin", origin: "https://evil.com", want: false},
+		{name: "rejects_lookalike_domain", origin: "https://evilexample.org", want: false},
+		{name: "allows_any_origin_in_dev_mode", devMode: "true", origin: "https://evil.com", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WS_ALLOWED_ORIGINS", "https://app.example.com, https://*.example.org")
+			t.Setenv("WS_DEV_MODE", tt.devMode)
+			connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+			s := httptest.NewServer(http.HandlerFunc(connHandler.HandleSocket))
+			defer s.Close()
+
+			header := http.Header{}
+			header.Set("Authorization", "Bearer token1")
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/api/v0/ws", header)
+			if err == nil {
+				ws.Close()
+			}
+
+			if got := err == nil; got != tt.want {
+				t.Errorf("expected upgrade %v but got %v", tt.want, got)
+			}
+			if !tt.want && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+				t.Errorf("expected status %d but got '%v'", http.StatusForbidden, resp)
+			}
+		})
+	}
+}
+
+func TestConnectionManager_testStress(t *testing.T) {
+	connections := 2000
+	if testing.Short() {
+		connections = 200
+	}
+
+	connHandler := connectionManager.NewConnectionHandler(&MockMessageStorage{}, &MockUserStorage{}, &MockTicketStorage{}, &MockCognito{}, connectionManager.NewMemoryBroker())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/chat/{username}", connHandler.HandleConnections)
+	mux.HandleFunc("/api/v0/ws", connHandler.HandleSocket)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for worker := 0; worker < 50; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				token, peer := "token1", "user2"
+				if i%2 == 1 {
+					token, peer = "token2", "user1"
+				}
+
+				path := "/api/v0/ws"
+				if i%3 == 0 {
+					path = "/api/v0/chat/" + peer
+				}
+
+				header := http.Header{}
+				header.Set("Authorization", "Bearer "+token)
+				ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+path, header)
+				if err != nil {
+					t.Errorf("%v", err)
+					continue
+				}
+
+				// a third of the clients stay idle, with nothing to write to them
+				switch i % 3 {
+				case 0:
+					ws.WriteJSON(map[string]string{"type": "message", "body": "hello"})
+				case 1:
+					ws.WriteJSON(map[string]string{"type": "subscribe", "conversation": peer})
+					ws.WriteJSON(map[string]any{"type": "message", "conversation": peer, "payload": map[string]string{"body": "hello"}})
+				}
+				// half of the clients leave without a close frame
+				if i%4 < 2 {
+					ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				}
+				ws.Close()
+			}
+		}()
+	}
+
+	for i := 0; i < connections; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	waitFor(t, func() bool { return connHandler.Stats().Sessions == 0 })
+
+	// every per-connection goroutine returns with its connection
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected about %d goroutines but got %d", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
@@ -0,0 +1,86 @@
+package connectionManager
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// originPolicy decides which web pages may open a socket. Browsers always
+// send the Origin of the page, other clients needn't send any.
+type originPolicy struct {
+	// any accepts every origin, for development only.
+	any   bool
+	exact map[string]bool
+	// wildcards are the "scheme://*.domain" entries, as scheme and
+	// ".domain".
+	wildcards []wildcardOrigin
+}
+
+type wildcardOrigin struct {
+	scheme string
+	suffix string
+}
+
+// loadOriginPolicy reads WS_ALLOWED_ORIGINS, a comma separated list of
+// origins such as "https://app.example.com" or "https://*.example.com",
+// and WS_DEV_MODE, which accepts any origin when "true".
+func loadOriginPolicy() originPolicy {
+	policy := originPolicy{exact: make(map[string]bool)}
+
+	if os.Getenv("WS_DEV_MODE") == "true" {
+		fmt.Println("WS_DEV_MODE is on, websockets accept any origin")
+		policy.any = true
+	}
+
+	for _, entry := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		scheme, host, ok := strings.Cut(entry, "://")
+		if !ok || host == "" {
+			fmt.Println("invalid origin in WS_ALLOWED_ORIGINS: ", entry)
+			continue
+		}
+
+		if suffix, ok := strings.CutPrefix(host, "*."); ok {
+			policy.wildcards = append(policy.wildcards, wildcardOrigin{scheme: scheme, suffix: "." + suffix})
+			continue
+		}
+		policy.exact[scheme+"://"+host] = true
+	}
+
+	return policy
+}
+
+// allows reports whether r may be upgraded. Requests without an Origin,
+// and those from the origin of the app itself, are always allowed.
+func (p originPolicy) allows(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+
+	if strings.EqualFold(host, r.Host) || p.exact[scheme+"://"+host] {
+		return true
+	}
+
+	for _, w := range p.wildcards {
+		if scheme == w.scheme && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
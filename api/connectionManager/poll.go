@@ -0,0 +1,273 @@
+package connectionManager
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thaironsilva/messenger/api/resource/message"
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 60 * time.Second
+	// pollSettle is how long a message is held back from polls after it is
+	// created, so the messages created before it with a lower Seq have
+	// committed by the time it is returned.
+	pollSettle = 500 * time.Millisecond
+)
+
+var invalidCursorResponse = []byte(`{"message":"invalid cursor"}`)
+var missingCursorResponse = []byte(`{"message":"cursor is required"}`)
+var invalidTimeoutResponse = []byte(`{"message":"timeout must be 1 to 60 seconds"}`)
+
+// pollResponse is the body of a long poll. Cursor is the Seq to poll from
+// next.
+type pollResponse struct {
+	Messages []message.Message `json:"messages"`
+	Cursor   int64             `json:"cursor"`
+}
+
+// pollers tracks the long polls waiting for messages, by username, so a
+// message delivered to a user ends their polls at once. It also remembers
+// the highest Seq polls returned of each conversation, which is as far as
+// a poll can acknowledge.
+type pollers struct {
+	mu       sync.Mutex
+	waiting  map[string]map[chan struct{}]bool
+	returned map[pollKey]int64
+}
+
+// pollKey is a conversation, from the side of the polling user.
+type pollKey struct {
+	username string
+	peer     string
+}
+
+func newPollers() *pollers {
+	return &pollers{
+		waiting:  make(map[string]map[chan struct{}]bool),
+		returned: make(map[pollKey]int64),
+	}
+}
+
+// answered records that a poll of username returned the messages of peers
+// up to seq.
+func (p *pollers) answered(username string, peers []user.User, seq int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, peer := range peers {
+		key := pollKey{username: username, peer: peer.Username}
+		p.returned[key] = max(p.returned[key], seq)
+	}
+}
+
+// acknowledgeable caps cursor at the highest Seq of the messages of peer
+// returned to username.
+func (p *pollers) acknowledgeable(username string, peer string, cursor int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return min(cursor, p.returned[pollKey{username: username, peer: peer}])
+}
+
+// add returns a channel that is signaled when a message is delivered to
+// username, until it is removed.
+func (p *pollers) add(username string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	if p.waiting[username] == nil {
+		p.waiting[username] = make(map[chan struct{}]bool)
+	}
+	p.waiting[username][wake] = true
+	return wake
+}
+
+func (p *pollers) remove(username string, wake chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.waiting[username], wake)
+	if len(p.waiting[username]) == 0 {
+		delete(p.waiting, username)
+	}
+}
+
+func (p *pollers) wake(username string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for wake := range p.waiting[username] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// count is how many polls are waiting.
+func (p *pollers) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	for _, waiting := range p.waiting {
+		count += len(waiting)
+	}
+	return count
+}
+
+// HandlePoll serves /api/v0/poll, a long poll for clients that can hold
+// neither a websocket nor a stream. It answers with the messages the
+// conversations named by its conversation parameters got after the cursor
+// parameter, waiting up to the timeout parameter, in seconds, for one to
+// arrive. The cursor is the poll's own: the delivery cursors the sockets
+// replay from are left alone. Messages are returned once they settle, and
+// polling from a cursor acknowledges those returned up to it.
+func (h *ConnectionHandler) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	current, _, ok := h.authenticate(w, r, "")
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if len(query["conversation"]) == 0 {
+		writeError(w, http.StatusBadRequest, missingConversationResponse)
+		return
+	}
+
+	value := query.Get("cursor")
+	if value == "" {
+		writeError(w, http.StatusBadRequest, missingCursorResponse)
+		return
+	}
+	cursor, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || cursor < 0 {
+		writeError(w, http.StatusBadRequest, invalidCursorResponse)
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if value := query.Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPollTimeout {
+			writeError(w, http.StatusBadRequest, invalidTimeoutResponse)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	var peers []user.User
+	for _, username := range query["conversation"] {
+		peer, err := h.userStorage.GetByUsername(username)
+		if err != nil {
+			writeUserError(w, err)
+			return
+		}
+		peers = append(peers, peer)
+	}
+
+	// polling from cursor acknowledges the messages up to it, as far as
+	// they were returned
+	for _, peer := range peers {
+		if seq := h.pollers.acknowledgeable(current.Username, peer.Username, cursor); seq > 0 {
+			h.markDelivered(current, peer, seq)
+		}
+	}
+
+	// waiting starts before the first look, so a message stored in between
+	// still wakes the poll
+	wake := h.pollers.add(current.Username)
+	defer h.pollers.remove(current.Username, wake)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		response, settling, err := h.poll(current, peers, cursor)
+		if err != nil {
+			fmt.Println("error polling messages: ", err)
+			writeError(w, http.StatusInternalServerError, []byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		if len(response.Messages) == 0 {
+			var settled <-chan time.Time
+			if settling > 0 {
+				settled = time.After(settling)
+			}
+			select {
+			case <-wake:
+				continue
+			case <-settled:
+				continue
+			case <-timer.C:
+			case <-h.stopping:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if len(response.Messages) > 0 {
+			h.pollers.answered(current.Username, peers, response.Cursor)
+		}
+		now := time.Now()
+		for i := range response.Messages {
+			response.Messages[i] = response.Messages[i].Signed(now)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+}
+
+// poll loads, in Seq order, up to replayBatch messages the peers sent to
+// reader after cursor. Messages created within pollSettle are held back,
+// with those after them; settling is how long until the first of them can
+// be returned.
+func (h *ConnectionHandler) poll(reader user.User, peers []user.User, cursor int64) (pollResponse, time.Duration, error) {
+	response := pollResponse{Messages: []message.Message{}, Cursor: cursor}
+
+	for _, peer := range peers {
+		messages, err := h.messageStorage.GetUndelivered(reader.Id, peer.Id, cursor, replayBatch)
+		if err != nil {
+			return response, 0, err
+		}
+		response.Messages = append(response.Messages, messages...)
+	}
+
+	// the first replayBatch messages of all the peers, so none is skipped
+	// by the next cursor
+	slices.SortFunc(response.Messages, func(a, b message.Message) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+	if len(response.Messages) > replayBatch {
+		response.Messages = response.Messages[:replayBatch]
+	}
+
+	// a message with a lower Seq may still commit before a recent one
+	var settling time.Duration
+	now := time.Now()
+	for i, msg := range response.Messages {
+		if wait := msg.CreatedAt.Add(pollSettle).Sub(now); wait > 0 {
+			response.Messages = response.Messages[:i]
+			settling = wait
+			break
+		}
+	}
+
+	if len(response.Messages) > 0 {
+		response.Cursor = response.Messages[len(response.Messages)-1].Seq
+	}
+	return response, settling, nil
+}
@@ -0,0 +1,110 @@
+package connectionManager
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const notifyChannel = "messenger_deliveries"
+
+// maxNotifyPayload keeps payloads under the 8000 bytes Postgres accepts in
+// a NOTIFY.
+const maxNotifyPayload = 7900
+
+var ErrDeliveryTooLarge = errors.New("delivery too large to publish")
+
+// PostgresBroker is a Broker over Postgres LISTEN/NOTIFY, so instances
+// sharing a database deliver to each other's sessions. Deliveries published
+// while an instance is reconnecting to the database are lost to it; the
+// messages among them are replayed from storage when clients reconnect.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	mu       sync.RWMutex
+	handlers []func(delivery Delivery)
+}
+
+// NewPostgresBroker listens for deliveries over a connection of its own,
+// opened with connInfo, and publishes them through db.
+func NewPostgresBroker(db *sql.DB, connInfo string) (*PostgresBroker, error) {
+	listener := pq.NewListener(connInfo, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			fmt.Println("broker connection: ", err)
+		}
+	})
+
+	if err := listener.Listen(notifyChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &PostgresBroker{
+		db:       db,
+		listener: listener,
+	}
+	go b.listen()
+
+	return b, nil
+}
+
+// Publish sends delivery to every instance. A message too large for a
+// NOTIFY is published by id.
+func (b *PostgresBroker) Publish(delivery Delivery) error {
+	payload, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > maxNotifyPayload && delivery.Message != nil {
+		delivery.MessageId = delivery.Message.Id
+		delivery.Message = nil
+		if payload, err = json.Marshal(delivery); err != nil {
+			return err
+		}
+	}
+
+	if len(payload) > maxNotifyPayload {
+		return ErrDeliveryTooLarge
+	}
+
+	_, err = b.db.Exec("SELECT pg_notify($1, $2)", notifyChannel, string(payload))
+	return err
+}
+
+func (b *PostgresBroker) Subscribe(handle func(delivery Delivery)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, handle)
+}
+
+func (b *PostgresBroker) listen() {
+	for notification := range b.listener.Notify {
+		// a nil notification follows a reconnection
+		if notification == nil {
+			continue
+		}
+
+		var delivery Delivery
+		if err := json.Unmarshal([]byte(notification.Extra), &delivery); err != nil {
+			fmt.Println("invalid delivery: ", err)
+			continue
+		}
+
+		b.mu.RLock()
+		for _, handle := range b.handlers {
+			handle(delivery)
+		}
+		b.mu.RUnlock()
+	}
+}
+
+func (b *PostgresBroker) Close() error {
+	return b.listener.Close()
+}
@@ -0,0 +1,78 @@
+package connectionManager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// registry tracks the open sessions of every user, by session id, so a
+// user can be connected from several devices at once.
+type registry struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]*session
+}
+
+func newRegistry() *registry {
+	return &registry{
+		sessions: make(map[string]map[string]*session),
+	}
+}
+
+func (r *registry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions, ok := r.sessions[s.user.Username]
+	if !ok {
+		sessions = make(map[string]*session)
+		r.sessions[s.user.Username] = sessions
+	}
+	sessions[s.id] = s
+}
+
+// remove drops s, leaving the other sessions of its user untouched.
+func (r *registry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := r.sessions[s.user.Username]
+	delete(sessions, s.id)
+	if len(sessions) == 0 {
+		delete(r.sessions, s.user.Username)
+	}
+}
+
+// of lists the open sessions of username.
+func (r *registry) of(username string) []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]*session, 0, len(r.sessions[username]))
+	for _, s := range r.sessions[username] {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// all lists every open session.
+func (r *registry) all() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sessions []*session
+	for _, byId := range r.sessions {
+		for _, s := range byId {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+func newSessionId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
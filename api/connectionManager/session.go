@@ -0,0 +1,651 @@
+package connectionManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/thaironsilva/messenger/api/resource/message"
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+const (
+	envelopeSubscribe    = "subscribe"
+	envelopeUnsubscribe  = "unsubscribe"
+	envelopeSubscribed   = "subscribed"
+	envelopeUnsubscribed = "unsubscribed"
+	envelopeError        = "error"
+	envelopeSession      = "session"
+	envelopeOverflow     = "overflow"
+	envelopeAck          = "ack"
+)
+
+// closeTooSlow is the close code of sessions disconnected by the
+// overflowDisconnect policy.
+const closeTooSlow = websocket.ClosePolicyViolation
+
+// closeShutdownReason tells clients closed by a shutdown to reconnect, to
+// another instance or once this one is back.
+const closeShutdownReason = "server shutting down, reconnect"
+
+// envelope is the frame of the /api/v0/ws socket, in both directions.
+// Conversation is the username of the other participant, and Id correlates
+// a reply with the client frame it answers, or names the message carried.
+type envelope struct {
+	Type         string          `json:"type"`
+	Conversation string          `json:"conversation,omitempty"`
+	Id           string          `json:"id,omitempty"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+}
+
+// sessionEvent is the first envelope of a /api/v0/ws session, telling the
+// client the id of its session.
+type sessionEvent struct {
+	Id string `json:"id"`
+}
+
+// errorPayload is the payload of error envelopes.
+type errorPayload struct {
+	ClientId string `json:"clientId,omitempty"`
+	Message  string `json:"message"`
+}
+
+// messageAck tells a client that one of its messages was stored, with the
+// id and creation time the server gave it.
+type messageAck struct {
+	Type      string    `json:"type"`
+	ClientId  string    `json:"clientId,omitempty"`
+	Id        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ackPayload is the payload of ack envelopes.
+type ackPayload struct {
+	ClientId  string    `json:"clientId,omitempty"`
+	Id        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// overflowEvent tells a client how many events and copies of its own
+// messages were dropped because it fell behind.
+type overflowEvent struct {
+	Type    string `json:"type"`
+	Dropped int64  `json:"dropped"`
+}
+
+// overflowPayload is the payload of overflow envelopes.
+type overflowPayload struct {
+	Dropped int64 `json:"dropped"`
+}
+
+// conversation is a peer a session follows.
+type conversation struct {
+	peer   user.User
+	typing *typingState
+}
+
+// outbound is an item waiting to be written to a session's socket.
+type outbound struct {
+	peer user.User
+	// id is the client frame this item answers, if any.
+	id    string
+	msg   *message.Message
+	event any
+	// replay asks the writer to send the stored messages of peer it missed,
+	// forget to drop what it knows of peer once unfollowed.
+	replay bool
+	forget bool
+	// own marks a message the session's user sent from another device.
+	own bool
+	// received carries the client's acknowledgement of the messages of
+	// peer up to seq, or of all those written when seq is 0.
+	received bool
+	seq      int64
+}
+
+// sentWindow is how far below the highest Seq written to a session the
+// Seqs of the messages written are remembered. A message committed out of
+// Seq order is expected within it.
+const sentWindow = 10000
+
+// sent is what the writer of a session wrote of the messages of a peer.
+type sent struct {
+	// cursor is the highest Seq written.
+	cursor int64
+	seqs   map[int64]bool
+}
+
+func newSent() *sent {
+	return &sent{seqs: make(map[int64]bool)}
+}
+
+// add records that the message seq is written, unless it was already.
+func (p *sent) add(seq int64) bool {
+	if p.seqs[seq] {
+		return false
+	}
+	p.seqs[seq] = true
+	if seq > p.cursor {
+		p.cursor = seq
+		for old := range p.seqs {
+			if old <= p.cursor-sentWindow {
+				delete(p.seqs, old)
+			}
+		}
+	}
+	return true
+}
+
+// session is one client socket. It receives the messages and events of the
+// conversations it follows: a legacy /api/v0/chat/{username} session follows
+// username for its whole life, a /api/v0/ws session the conversations it
+// subscribes to, and a /api/v0/events session, which has a stream instead
+// of a socket, the conversations it was opened with.
+type session struct {
+	id     string
+	h      *ConnectionHandler
+	user   user.User
+	conn   *websocket.Conn
+	stream *eventStream
+	legacy bool
+	// device keeps the delivery cursors of the session apart from those of
+	// the user's other devices.
+	device string
+	// fullMessages has a legacy session get whole messages, not just their
+	// body. Only then can its client acknowledge them: the others predate
+	// received frames, so what is written to them is acknowledged at once.
+	fullMessages bool
+	out          chan outbound
+	// ctx ends with the session, stopping its writer and closing conn.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	// draining asks the writer to flush the queue and say goodbye.
+	draining chan struct{}
+	drained  sync.Once
+	// wake tells the writer that messages were dropped and need a replay.
+	wake chan struct{}
+
+	// dropped counts what was dropped and can't be replayed, until the
+	// client is told.
+	dropped    atomic.Int64
+	overflowed sync.Once
+
+	// typingFrames limits the typing frames the client sends, across its
+	// conversations.
+	typingFrames *tokenBucket
+
+	mu    sync.Mutex
+	peers map[string]*conversation
+	// behind holds the peers whose messages were dropped.
+	behind map[string]user.User
+}
+
+// newSession wraps conn, limiting the size of client frames and closing it
+// once the client stays silent, pongs included, for longer than the pong
+// timeout, or once ctx is done.
+func newSession(ctx context.Context, h *ConnectionHandler, current user.User, conn *websocket.Conn, legacy bool) *session {
+	conn.SetReadLimit(h.config.maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(h.config.pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(h.config.pongTimeout))
+	})
+
+	s := openSession(ctx, h, current, legacy)
+	s.conn = conn
+	// closing the socket ends the read loop of the session
+	context.AfterFunc(s.ctx, func() {
+		conn.Close()
+	})
+	return s
+}
+
+// newStreamSession wraps stream. The session ends once ctx, the context of
+// the stream's request, is done.
+func newStreamSession(ctx context.Context, h *ConnectionHandler, current user.User, stream *eventStream) *session {
+	s := openSession(ctx, h, current, false)
+	s.stream = stream
+	return s
+}
+
+func openSession(ctx context.Context, h *ConnectionHandler, current user.User, legacy bool) *session {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &session{
+		id:       newSessionId(),
+		h:        h,
+		user:     current,
+		legacy:   legacy,
+		out:      make(chan outbound, h.config.queueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+		draining: make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+
+		typingFrames: newTokenBucket(typingBurst, typingRefill),
+		peers:        make(map[string]*conversation),
+		behind:       make(map[string]user.User),
+	}
+}
+
+// start runs the writer of the session until it closes.
+func (s *session) start() {
+	go func() {
+		defer close(s.stopped)
+		s.write()
+	}()
+}
+
+// read reads the next client frame into v. Any frame proves the client
+// alive, like a pong. Frames that aren't JSON close the session.
+func (s *session) read(v any) error {
+	if err := s.conn.ReadJSON(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			s.closeWith(websocket.CloseInvalidFramePayloadData, "invalid frame")
+		}
+		return err
+	}
+	return s.conn.SetReadDeadline(time.Now().Add(s.h.config.pongTimeout))
+}
+
+// follow starts delivering the conversation with peer, beginning with the
+// messages stored since the session's user was last sent one.
+func (s *session) follow(peer user.User) {
+	s.mu.Lock()
+	_, ok := s.peers[peer.Username]
+	if !ok {
+		s.peers[peer.Username] = &conversation{
+			peer: peer,
+			typing: newTypingState(s.user.Username, func(event typingEvent) {
+				s.h.Notify(s.user.Username, peer.Username, event)
+			}),
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		s.enqueue(outbound{peer: peer, replay: true})
+	}
+}
+
+func (s *session) unfollow(username string) {
+	s.mu.Lock()
+	c, ok := s.peers[username]
+	delete(s.peers, username)
+	s.mu.Unlock()
+
+	if ok {
+		c.typing.stop()
+		s.enqueue(outbound{peer: c.peer, forget: true})
+	}
+}
+
+// following returns the conversation with username, if the session follows
+// it.
+func (s *session) following(username string) (*conversation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.peers[username]
+	return c, ok
+}
+
+// close stops the typing indicators of the session, closes its socket and
+// waits for its writer to return.
+func (s *session) close() {
+	s.mu.Lock()
+	for _, c := range s.peers {
+		c.typing.stop()
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+	<-s.stopped
+}
+
+// closeWith ends the session with a close frame telling the client why.
+// The frame is lost if the socket is already broken. Streams just end.
+func (s *session) closeWith(code int, reason string) {
+	if s.conn != nil {
+		deadline := time.Now().Add(s.h.config.writeTimeout)
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	}
+	s.cancel()
+}
+
+// drain makes the writer write what is queued, then close the socket with
+// a going away close frame.
+func (s *session) drain() {
+	s.drained.Do(func() {
+		close(s.draining)
+	})
+}
+
+// enqueue waits for room in the outbound queue, unless the session closes.
+// Only the session's own reader may wait: it only holds up its client.
+func (s *session) enqueue(item outbound) {
+	select {
+	case s.out <- item:
+	case <-s.ctx.Done():
+	}
+}
+
+// push queues item without blocking, so a slow client never holds up the
+// others. When the queue is full the overflow policy applies.
+func (s *session) push(item outbound) {
+	select {
+	case s.out <- item:
+		return
+	default:
+	}
+
+	if s.h.config.overflow == overflowDisconnect {
+		s.overflowed.Do(func() {
+			s.h.disconnected.Add(1)
+			fmt.Println("disconnecting slow client ", s.user.Username)
+			// the writer may be stuck on the socket until its deadline
+			go s.closeWith(closeTooSlow, "client too slow")
+		})
+		return
+	}
+
+	s.h.dropped.Add(1)
+	if item.msg != nil && !item.own {
+		// the message is stored, the writer replays it
+		s.mu.Lock()
+		s.behind[item.peer.Username] = item.peer
+		s.mu.Unlock()
+
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	s.dropped.Add(1)
+}
+
+// depth is how many items wait in the outbound queue.
+func (s *session) depth() int {
+	return len(s.out)
+}
+
+// write is the only writer of the socket. It pings the client, replays
+// missed messages when the session starts following a conversation or
+// after some were dropped, and skips the live ones of a conversation it
+// hasn't replayed yet or that it wrote already.
+// A failed write cancels the session, which ends its read loop.
+func (s *session) write() {
+	// cursors holds what was written per peer; a received frame without
+	// seq acknowledges up to its cursor. Live messages of a peer whose
+	// replay hasn't run yet are skipped: they are stored, so the replay
+	// sends them.
+	cursors := make(map[string]*sent)
+
+	ping := time.NewTicker(s.h.config.pingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.draining:
+			s.flush(cursors)
+			return
+		case <-ping.C:
+			deadline := time.Now().Add(s.h.config.writeTimeout)
+			if s.stream != nil {
+				err = s.stream.ping(deadline)
+			} else {
+				err = s.conn.WriteControl(websocket.PingMessage, nil, deadline)
+			}
+		case <-s.wake:
+			err = s.catchUp(cursors)
+		case item := <-s.out:
+			if err = s.writeItem(item, cursors); err == nil {
+				err = s.catchUp(cursors)
+			}
+		}
+
+		if err != nil {
+			fmt.Println("error writing to client: ", err)
+			s.closeWith(websocket.CloseInternalServerErr, "internal error")
+			return
+		}
+	}
+}
+
+// flush writes the items left in the queue and closes the session with
+// CloseGoingAway.
+func (s *session) flush(cursors map[string]*sent) {
+	defer s.cancel()
+
+	for {
+		select {
+		case item := <-s.out:
+			if err := s.writeItem(item, cursors); err != nil {
+				fmt.Println("error writing to client: ", err)
+				return
+			}
+		default:
+			// clients of a stream reconnect once it ends
+			if s.stream != nil {
+				return
+			}
+			deadline := time.Now().Add(s.h.config.writeTimeout)
+			if err := s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, closeShutdownReason), deadline); err != nil {
+				return
+			}
+			// the reader returns once the client answers the close frame;
+			// closing the socket earlier could reset it before the frame
+			// arrives
+			select {
+			case <-s.ctx.Done():
+			case <-time.After(s.h.config.writeTimeout):
+			}
+			return
+		}
+	}
+}
+
+// writeItem writes a queued item, keeping cursors up to date.
+func (s *session) writeItem(item outbound, cursors map[string]*sent) error {
+	switch {
+	case item.replay:
+		written, ok := cursors[item.peer.Username]
+		if !ok {
+			written = newSent()
+			cursors[item.peer.Username] = written
+		}
+		if err := s.h.replay(s, item.peer, written); err != nil {
+			return err
+		}
+		s.autoAcknowledge(item.peer, written.cursor)
+	case item.forget:
+		delete(cursors, item.peer.Username)
+	case item.received:
+		// clients can't acknowledge messages they weren't sent
+		written, ok := cursors[item.peer.Username]
+		if !ok || written.cursor == 0 {
+			return nil
+		}
+		seq := written.cursor
+		if item.seq > 0 {
+			seq = min(item.seq, written.cursor)
+		}
+		s.h.acknowledge(s.user, item.peer, s.device, seq)
+	case item.own:
+		// the cursor only tracks the messages of the peer
+		return s.writeMessage(item.peer, *item.msg)
+	case item.msg != nil:
+		// a message committed after a later Seq was written is not written
+		// yet, so only the Seqs written are skipped
+		written, ok := cursors[item.peer.Username]
+		if !ok || !written.add(item.msg.Seq) {
+			return nil
+		}
+		if err := s.writeMessage(item.peer, *item.msg); err != nil {
+			return err
+		}
+		s.autoAcknowledge(item.peer, item.msg.Seq)
+	default:
+		return s.writeEvent(item.peer, item.id, item.event)
+	}
+	return nil
+}
+
+// autoAcknowledge acknowledges the messages of peer written up to seq for
+// the legacy clients that can't do it themselves.
+func (s *session) autoAcknowledge(peer user.User, seq int64) {
+	if s.legacy && !s.fullMessages && seq > 0 {
+		s.h.acknowledge(s.user, peer, s.device, seq)
+	}
+}
+
+// catchUp replays the conversations whose messages were dropped, and tells
+// the client how much else it lost.
+func (s *session) catchUp(cursors map[string]*sent) error {
+	s.mu.Lock()
+	behind := s.behind
+	s.behind = make(map[string]user.User)
+	s.mu.Unlock()
+
+	for username, peer := range behind {
+		// without a cursor, the conversation is unfollowed or its replay
+		// is still queued
+		written, ok := cursors[username]
+		if !ok {
+			continue
+		}
+		if err := s.h.replay(s, peer, written); err != nil {
+			return err
+		}
+		s.autoAcknowledge(peer, written.cursor)
+	}
+
+	if dropped := s.dropped.Swap(0); dropped > 0 {
+		return s.writeEvent(user.User{}, "", overflowEvent{Type: envelopeOverflow, Dropped: dropped})
+	}
+	return nil
+}
+
+// writeMessage sends msg, from the conversation with peer, with signed
+// attachment URLs. Legacy sessions only get its body, unless they asked for
+// full messages.
+func (s *session) writeMessage(peer user.User, msg message.Message) error {
+	// the session's user takes part in the conversation
+	msg = msg.Signed(time.Now())
+	if s.legacy && s.fullMessages {
+		return s.writeJSON(msg)
+	}
+	if s.legacy {
+		return s.writeJSON(msg.Body)
+	}
+
+	e, err := newEnvelope(frameMessage, peer.Username, msg.Id, msg)
+	if err != nil {
+		return err
+	}
+	if s.stream != nil {
+		deadline := time.Now().Add(s.h.config.writeTimeout)
+		// the user's own messages are not replayed, so they don't move
+		// the stream's position
+		if msg.SenderId == s.user.Id {
+			return s.stream.write(e, deadline)
+		}
+		return s.stream.writeMessage(e, peer.Username, msg.Seq, deadline)
+	}
+	return s.writeJSON(e)
+}
+
+// writeEvent sends a routed Event or a reply to the session's own frames.
+// Legacy sessions get events as they are, without envelope.
+func (s *session) writeEvent(peer user.User, id string, event any) error {
+	switch e := event.(type) {
+	case Event:
+		if s.legacy {
+			return s.writeJSON(e.Payload)
+		}
+		return s.writeEnvelope(e.Type, peer.Username, id, e.Payload)
+	case errorEvent:
+		if s.legacy {
+			return s.writeJSON(e)
+		}
+		return s.writeEnvelope(envelopeError, peer.Username, id, errorPayload{ClientId: e.ClientId, Message: e.Message})
+	case messageAck:
+		if s.legacy {
+			return s.writeJSON(e)
+		}
+		return s.writeEnvelope(envelopeAck, peer.Username, id, ackPayload{ClientId: e.ClientId, Id: e.Id, CreatedAt: e.CreatedAt})
+	case ack:
+		return s.writeEnvelope(e.Type, peer.Username, id, nil)
+	case sessionEvent:
+		return s.writeEnvelope(envelopeSession, "", id, e)
+	case overflowEvent:
+		if s.legacy {
+			return s.writeJSON(e)
+		}
+		return s.writeEnvelope(envelopeOverflow, "", id, overflowPayload{Dropped: e.Dropped})
+	}
+	return fmt.Errorf("unknown event %T", event)
+}
+
+func (s *session) writeEnvelope(kind string, conversation string, id string, payload any) error {
+	e, err := newEnvelope(kind, conversation, id, payload)
+	if err != nil {
+		return err
+	}
+	if s.stream != nil {
+		return s.stream.write(e, time.Now().Add(s.h.config.writeTimeout))
+	}
+	return s.writeJSON(e)
+}
+
+func newEnvelope(kind string, conversation string, id string, payload any) (envelope, error) {
+	e := envelope{Type: kind, Conversation: conversation, Id: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return e, err
+		}
+		e.Payload = raw
+	}
+	return e, nil
+}
+
+// writeJSON sends v, giving up after the write timeout so a client that
+// stopped reading can't hold the writer forever.
+func (s *session) writeJSON(v any) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.h.config.writeTimeout)); err != nil {
+		return err
+	}
+	return s.conn.WriteJSON(v)
+}
+
+// eventType is the envelope type events are pushed with.
+func eventType(event any) string {
+	switch e := event.(type) {
+	case message.Receipt:
+		return e.Type
+	case message.ReactionEvent:
+		return e.Type
+	case typingEvent:
+		return e.Type
+	}
+	return "event"
+}
+
+// ack answers subscribe and unsubscribe envelopes, with no payload.
+type ack struct {
+	Type string
+}
@@ -0,0 +1,37 @@
+package connectionManager
+
+// Stats is a snapshot of the outbound queues and long polls of a
+// ConnectionHandler.
+type Stats struct {
+	Sessions  int `json:"sessions"`
+	QueueSize int `json:"queueSize"`
+	// Queued is the total of Queues, MaxQueued the deepest of them.
+	Queued    int `json:"queued"`
+	MaxQueued int `json:"maxQueued"`
+	// Queues is the depth of each session's queue, by session id.
+	Queues map[string]int `json:"queues"`
+	// Dropped and Disconnected count the overflows since the start.
+	Dropped      int64 `json:"dropped"`
+	Disconnected int64 `json:"disconnected"`
+	// Polls is how many long polls are waiting.
+	Polls int `json:"polls"`
+}
+
+func (h *ConnectionHandler) Stats() Stats {
+	stats := Stats{
+		QueueSize:    h.config.queueSize,
+		Queues:       make(map[string]int),
+		Dropped:      h.dropped.Load(),
+		Disconnected: h.disconnected.Load(),
+		Polls:        h.pollers.count(),
+	}
+
+	for _, s := range h.sessions.all() {
+		depth := s.depth()
+		stats.Sessions++
+		stats.Queued += depth
+		stats.MaxQueued = max(stats.MaxQueued, depth)
+		stats.Queues[s.id] = depth
+	}
+	return stats
+}
@@ -0,0 +1,237 @@
+package connectionManager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+var invalidLastEventIdResponse = []byte(`{"message":"invalid Last-Event-ID"}`)
+var missingConversationResponse = []byte(`{"message":"conversation is required"}`)
+
+// receivedRequest is the body of POST /api/v0/events/received.
+type receivedRequest struct {
+	Conversation string `json:"conversation"`
+	Seq          int64  `json:"seq"`
+}
+
+// eventStream is the Server-Sent Events response of a /api/v0/events
+// session. Envelopes are written as events named after their type, with the
+// envelope as data.
+//
+// Events carrying a message of a peer have an id, so a client reconnecting
+// with a Last-Event-ID is sent again what it may have missed. As a stream
+// mixes conversations, the id is not the Seq of the message but the lowest
+// Seq written last among the conversations: every conversation is complete
+// up to it. For that, events have no id until the first replay of every
+// conversation finished.
+type eventStream struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	// lastEventId is the Last-Event-ID the stream resumes from, 0 for a
+	// new one.
+	lastEventId int64
+	// written holds the highest Seq written per peer, resumed the peers
+	// replayed from lastEventId already, and replaying the peers whose
+	// first replay hasn't finished. Only the writer of the session uses
+	// them.
+	written   map[string]int64
+	resumed   map[string]bool
+	replaying map[string]bool
+}
+
+// newEventStream returns the stream of the conversations with peers.
+func newEventStream(w http.ResponseWriter, lastEventId int64, peers []string) *eventStream {
+	replaying := make(map[string]bool)
+	for _, peer := range peers {
+		replaying[peer] = true
+	}
+	return &eventStream{
+		w:           w,
+		controller:  http.NewResponseController(w),
+		lastEventId: lastEventId,
+		written:     make(map[string]int64),
+		resumed:     make(map[string]bool),
+		replaying:   replaying,
+	}
+}
+
+// replayed records that the first replay of peer finished.
+func (e *eventStream) replayed(peer string) {
+	delete(e.replaying, peer)
+}
+
+// resume returns the Last-Event-ID of a resumed stream on the first replay
+// of peer, which starts from it.
+func (e *eventStream) resume(peer string) (int64, bool) {
+	if e.lastEventId == 0 || e.resumed[peer] {
+		return 0, false
+	}
+	e.resumed[peer] = true
+	return e.lastEventId, true
+}
+
+// writeMessage writes an envelope carrying the message seq of peer.
+func (e *eventStream) writeMessage(env envelope, peer string, seq int64, deadline time.Time) error {
+	e.written[peer] = max(e.written[peer], seq)
+	// until every conversation is replayed, messages below any id may
+	// not be written yet
+	if len(e.replaying) > 0 {
+		return e.send(env, "", deadline)
+	}
+
+	id := seq
+	for _, written := range e.written {
+		id = min(id, written)
+	}
+	return e.send(env, strconv.FormatInt(id, 10), deadline)
+}
+
+// write writes an envelope without moving the stream's position.
+func (e *eventStream) write(env envelope, deadline time.Time) error {
+	return e.send(env, "", deadline)
+}
+
+// ping writes a comment, so that proxies don't close an idle stream.
+func (e *eventStream) ping(deadline time.Time) error {
+	return e.flush(deadline, ": ping\n\n")
+}
+
+func (e *eventStream) send(env envelope, id string, deadline time.Time) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	event := fmt.Sprintf("event: %s\ndata: %s\n\n", env.Type, data)
+	if id != "" {
+		event = "id: " + id + "\n" + event
+	}
+	return e.flush(deadline, event)
+}
+
+func (e *eventStream) flush(deadline time.Time, event string) error {
+	if err := e.controller.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := fmt.Fprint(e.w, event); err != nil {
+		return err
+	}
+	return e.controller.Flush()
+}
+
+// HandleEvents serves /api/v0/events, a Server-Sent Events stream for
+// clients that can't keep a websocket open. It delivers the /api/v0/ws
+// envelopes of the conversations named by its conversation parameters,
+// and nothing can be sent over it.
+func (h *ConnectionHandler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	current, _, ok := h.authenticate(w, r, "")
+	if !ok {
+		return
+	}
+
+	device, ok := deviceId(w, r)
+	if !ok {
+		return
+	}
+
+	usernames := r.URL.Query()["conversation"]
+	if len(usernames) == 0 {
+		writeError(w, http.StatusBadRequest, missingConversationResponse)
+		return
+	}
+
+	var lastEventId int64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 0 {
+			writeError(w, http.StatusBadRequest, invalidLastEventIdResponse)
+			return
+		}
+		lastEventId = id
+	}
+
+	var peers []user.User
+	for _, username := range usernames {
+		peer, err := h.userStorage.GetByUsername(username)
+		if err != nil {
+			writeUserError(w, err)
+			return
+		}
+		peers = append(peers, peer)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	var followed []string
+	for _, peer := range peers {
+		followed = append(followed, peer.Username)
+	}
+	stream := newEventStream(w, lastEventId, followed)
+	if err := stream.controller.Flush(); err != nil {
+		fmt.Println("streaming not supported: ", err)
+		return
+	}
+
+	s := newStreamSession(r.Context(), h, current, stream)
+	s.device = device
+	h.sessions.add(s)
+
+	defer func() {
+		h.sessions.remove(s)
+		s.close()
+	}()
+
+	s.start()
+
+	if h.closing.Load() {
+		s.drain()
+	}
+
+	s.push(outbound{event: sessionEvent{Id: s.id}})
+	for _, peer := range peers {
+		s.follow(peer)
+	}
+
+	<-s.ctx.Done()
+}
+
+// HandleReceived serves POST /api/v0/events/received, which acknowledges
+// the messages of a conversation up to seq for the clients of event
+// streams, as they can't send frames. Acknowledged messages are marked
+// delivered and not replayed again.
+func (h *ConnectionHandler) HandleReceived(w http.ResponseWriter, r *http.Request) {
+	current, _, ok := h.authenticate(w, r, "")
+	if !ok {
+		return
+	}
+
+	device, ok := deviceId(w, r)
+	if !ok {
+		return
+	}
+
+	var received receivedRequest
+	if err := json.NewDecoder(r.Body).Decode(&received); err != nil || received.Conversation == "" || received.Seq <= 0 {
+		writeError(w, http.StatusBadRequest, badRequestResponse)
+		return
+	}
+
+	peer, err := h.userStorage.GetByUsername(received.Conversation)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	h.acknowledge(current, peer, device, received.Seq)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package connectionManager
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	typingStart = "typing.start"
+	typingStop  = "typing.stop"
+
+	// typingTimeout is how long a typing indicator stays on without a new
+	// typing.start before the server stops it on the client's behalf.
+	typingTimeout = 5 * time.Second
+	// typingInterval is the minimum time between two typing.start frames
+	// relayed from the same connection.
+	typingInterval = time.Second
+	// typingBurst is how many typing frames, start and stop alike, a
+	// connection may send at once; then it gets one more every
+	// typingRefill. The excess is dropped.
+	typingBurst  = 4
+	typingRefill = 500 * time.Millisecond
+)
+
+// tokenBucket limits how often something happens: each time takes a token,
+// and tokens come back one per refill, up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	burst  int
+	refill time.Duration
+	tokens int
+	last   time.Time
+}
+
+func newTokenBucket(burst int, refill time.Duration) *tokenBucket {
+	return &tokenBucket{
+		burst:  burst,
+		refill: refill,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token, if there is one left.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if refilled := int(now.Sub(b.last) / b.refill); refilled > 0 {
+		b.tokens = min(b.burst, b.tokens+refilled)
+		b.last = b.last.Add(time.Duration(refilled) * b.refill)
+	}
+	if b.tokens == b.burst {
+		b.last = now
+	}
+
+	if b.tokens == 0 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// typingEvent tells a client that its peer started or stopped typing.
+// Typing events are relayed as they come and never persisted.
+type typingEvent struct {
+	Type string `json:"type"`
+	From string `json:"from"`
+}
+
+// typingState tracks the typing indicator one connection shows its peer.
+type typingState struct {
+	mu        sync.Mutex
+	notify    func(event typingEvent)
+	from      string
+	typing    bool
+	lastStart time.Time
+	timer     *time.Timer
+	// generation tells the current expiry timer apart from stale ones that
+	// fired while start was re-arming.
+	generation int
+}
+
+func newTypingState(from string, notify func(event typingEvent)) *typingState {
+	return &typingState{
+		from:   from,
+		notify: notify,
+	}
+}
+
+// start relays a typing.start unless one was relayed less than
+// typingInterval ago, and (re)arms the expiry timer either way.
+func (t *typingState) start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.generation++
+	generation := t.generation
+	t.timer = time.AfterFunc(typingTimeout, func() { t.expire(generation) })
+
+	now := time.Now()
+	if t.typing && now.Sub(t.lastStart) < typingInterval {
+		return
+	}
+
+	t.typing = true
+	t.lastStart = now
+	t.notify(typingEvent{Type: typingStart, From: t.from})
+}
+
+// stop relays a typing.stop if the peer was last told the client is typing.
+func (t *typingState) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopLocked()
+}
+
+func (t *typingState) expire(generation int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if generation == t.generation {
+		t.stopLocked()
+	}
+}
+
+func (t *typingState) stopLocked() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	if !t.typing {
+		return
+	}
+
+	t.typing = false
+	t.notify(typingEvent{Type: typingStop, From: t.from})
+}
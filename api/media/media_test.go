@@ -0,0 +1,86 @@
+package media_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/thaironsilva/messenger/api/media"
+)
+
+// exifSegment builds an APP1 segment holding an orientation tag followed by
+// a GPS IFD pointer, as phones write.
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte{'I', 'I', 0x2A, 0x00, 0x08, 0x00, 0x00, 0x00, 0x02, 0x00}
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112)
+	tiff = append(tiff, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0x00, 0x00)
+	tiff = append(tiff, 0x25, 0x88, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func TestStripMetadata_JPEG(t *testing.T) {
+	out := &bytes.Buffer{}
+	jpeg.Encode(out, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	encoded := out.Bytes()
+	comment := []byte{0xFF, 0xFE, 0x00, 0x07, 'p', 'a', 'r', 'i', 's'}
+
+	tests := []struct {
+		name            string
+		orientation     uint16
+		wantOrientation bool
+	}{
+		{name: "strip_keeps_orientation", orientation: 6, wantOrientation: true},
+		{name: "strip_drops_default_orientation", orientation: 1, wantOrientation: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte{0xFF, 0xD8}, exifSegment(tt.orientation)...)
+			data = append(data, comment...)
+			data = append(data, encoded[2:]...)
+
+			stripped, err := media.StripMetadata("image/jpeg", data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if bytes.Contains(stripped, []byte{0x25, 0x88}) || bytes.Contains(stripped, []byte("paris")) {
+				t.Error("expected the GPS pointer and the comment to be stripped")
+			}
+			if got := bytes.Contains(stripped, []byte("Exif")); got != tt.wantOrientation {
+				t.Errorf("expected orientation kept to be '%t' but got '%t'", tt.wantOrientation, got)
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+				t.Errorf("expected a valid JPEG but got: %v", err)
+			}
+		})
+	}
+}
+
+func TestDuration_WAV(t *testing.T) {
+	data := []byte("RIFF\x00\x00\x00\x00WAVEfmt ")
+	data = binary.LittleEndian.AppendUint32(data, 16)
+	data = append(data, 1, 0, 1, 0)
+	data = binary.LittleEndian.AppendUint32(data, 8000)
+	data = binary.LittleEndian.AppendUint32(data, 16000)
+	data = append(data, 2, 0, 16, 0)
+	data = append(data, "data"...)
+	data = binary.LittleEndian.AppendUint32(data, 24000)
+
+	duration, ok, err := media.Duration("audio/wave", bytes.NewReader(data))
+	if err != nil || !ok {
+		t.Fatalf("expected a duration but got '%t', %v", ok, err)
+	}
+	if duration != 1500*time.Millisecond {
+		t.Errorf("expected '1.5s' but got '%s'", duration)
+	}
+}
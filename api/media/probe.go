@@ -0,0 +1,187 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"time"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Dimensions reads the width and height of an image without decoding its
+// pixels.
+func Dimensions(data []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// Duration reads the playing time of WAV audio and MP4 video from their
+// headers. ok is false for other content types or when the headers don't
+// tell.
+func Duration(contentType string, r io.Reader) (duration time.Duration, ok bool, err error) {
+	switch contentType {
+	case "audio/wave":
+		return wavDuration(bufio.NewReader(r))
+	case "video/mp4":
+		return mp4Duration(bufio.NewReader(r))
+	}
+	return 0, false, nil
+}
+
+// wavDuration divides the size of the data chunk by the byte rate given in
+// the fmt chunk.
+func wavDuration(r io.Reader) (time.Duration, bool, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, false, err
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return 0, false, ErrMalformed
+	}
+
+	var byteRate uint32
+	chunk := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return 0, false, err
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			if size < 12 || size > 1024 {
+				return 0, false, ErrMalformed
+			}
+			format := make([]byte, size)
+			if _, err := io.ReadFull(r, format); err != nil {
+				return 0, false, err
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:])
+			if size%2 == 1 {
+				io.CopyN(io.Discard, r, 1)
+			}
+		case "data":
+			if byteRate == 0 {
+				return 0, false, nil
+			}
+			return time.Duration(size) * time.Second / time.Duration(byteRate), true, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return 0, false, err
+			}
+		}
+	}
+}
+
+// mp4Duration walks the top level boxes up to moov and reads the timescale
+// and duration of its mvhd box.
+func mp4Duration(r io.Reader) (time.Duration, bool, error) {
+	for {
+		name, size, err := readBox(r)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if name != "moov" {
+			if size < 0 {
+				return 0, false, nil
+			}
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return 0, false, err
+			}
+			continue
+		}
+
+		moov := r
+		if size >= 0 {
+			moov = io.LimitReader(r, size)
+		}
+
+		for {
+			name, size, err := readBox(moov)
+			if err != nil {
+				return 0, false, err
+			}
+			if name == "mvhd" {
+				return readMvhd(moov)
+			}
+			if size < 0 {
+				return 0, false, nil
+			}
+			if _, err := io.CopyN(io.Discard, moov, size); err != nil {
+				return 0, false, err
+			}
+		}
+	}
+}
+
+// readBox reads an MP4 box header and returns the size of its payload, or
+// -1 when the box runs to the end of the file.
+func readBox(r io.Reader) (string, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+
+	name := string(header[4:])
+	size := int64(binary.BigEndian.Uint32(header))
+
+	switch size {
+	case 0:
+		return name, -1, nil
+	case 1:
+		large := make([]byte, 8)
+		if _, err := io.ReadFull(r, large); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(large)) - 16
+	default:
+		size -= 8
+	}
+
+	if size < 0 {
+		return "", 0, ErrMalformed
+	}
+	return name, size, nil
+}
+
+func readMvhd(r io.Reader) (time.Duration, bool, error) {
+	version := make([]byte, 4)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return 0, false, err
+	}
+
+	var timescale, duration uint64
+
+	if version[0] == 1 {
+		fields := make([]byte, 28)
+		if _, err := io.ReadFull(r, fields); err != nil {
+			return 0, false, err
+		}
+		timescale = uint64(binary.BigEndian.Uint32(fields[16:]))
+		duration = binary.BigEndian.Uint64(fields[20:])
+	} else {
+		fields := make([]byte, 16)
+		if _, err := io.ReadFull(r, fields); err != nil {
+			return 0, false, err
+		}
+		timescale = uint64(binary.BigEndian.Uint32(fields[8:]))
+		duration = uint64(binary.BigEndian.Uint32(fields[12:]))
+	}
+
+	if timescale == 0 {
+		return 0, false, nil
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), true, nil
+}
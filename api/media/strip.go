@@ -0,0 +1,221 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMalformed = errors.New("malformed media file")
+
+// StripMetadata removes the metadata that may identify a user, such as EXIF
+// GPS coordinates, camera serial numbers and text comments, from JPEG, PNG
+// and WebP images. Other content types are returned untouched.
+func StripMetadata(contentType string, data []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/webp":
+		return stripWebP(data)
+	}
+	return data, nil
+}
+
+// stripJPEG drops the APP1 (EXIF, XMP), APP13 (Photoshop) and comment
+// segments of a JPEG. The EXIF orientation is kept, in an EXIF segment of
+// its own, so photos are still displayed upright.
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrMalformed
+	}
+
+	var segments [][]byte
+	orientation := uint16(0)
+	i := 2
+
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, ErrMalformed
+		}
+
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// start of scan: the compressed image data follows, up to the end
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrMalformed
+		}
+
+		switch marker {
+		case 0xE1:
+			if o := exifOrientation(data[i+4 : end]); o != 0 {
+				orientation = o
+			}
+		case 0xED, 0xFE:
+		default:
+			segments = append(segments, data[i:end])
+		}
+
+		i = end
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	// EXIF goes right after the JFIF header, when there is one
+	if len(segments) > 0 && segments[0][1] == 0xE0 {
+		out.Write(segments[0])
+		segments = segments[1:]
+	}
+	if orientation > 1 {
+		out.Write(orientationSegment(orientation))
+	}
+	for _, segment := range segments {
+		out.Write(segment)
+	}
+	out.Write(data[i:])
+
+	return out.Bytes(), nil
+}
+
+// exifOrientation reads the orientation tag from the IFD0 of an APP1
+// segment payload, returning 0 when there is none.
+func exifOrientation(payload []byte) uint16 {
+	if len(payload) < 14 || string(payload[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := payload[6:]
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 0
+	}
+
+	entries := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := order.Uint16(tiff[entry+8:])
+			if orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
+}
+
+// orientationSegment builds an APP1 segment whose EXIF data holds nothing
+// but the orientation tag.
+func orientationSegment(orientation uint16) []byte {
+	segment := []byte{
+		0xFF, 0xE1, 0x00, 0x22,
+		'E', 'x', 'i', 'f', 0x00, 0x00,
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08,
+		0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	binary.BigEndian.PutUint16(segment[28:], orientation)
+	return segment
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadata are the PNG chunks dropped by stripPNG.
+var pngMetadata = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrMalformed
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, ErrMalformed
+		}
+
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrMalformed
+		}
+
+		if !pngMetadata[string(data[i+4:i+8])] {
+			out.Write(data[i:end])
+		}
+
+		i = end
+	}
+
+	return out.Bytes(), nil
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP image and clears the
+// flags announcing them.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrMalformed
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrMalformed
+		}
+
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			return nil, ErrMalformed
+		}
+
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+
+		i = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
@@ -0,0 +1,65 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// maxPixels bounds the images Thumbnail decodes, so a small file claiming
+// huge dimensions can't exhaust memory.
+const maxPixels = 50_000_000
+
+var ErrTooLarge = errors.New("image too large to thumbnail")
+
+// Thumbnail scales the image read from r down to fit in a size x size box
+// and encodes it as JPEG, or as PNG when the image may be transparent. It
+// returns the encoded thumbnail with its content type.
+func Thumbnail(r io.Reader, size int) ([]byte, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	width, height := fit(config.Width, config.Height, size)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	out := &bytes.Buffer{}
+	if format == "jpeg" {
+		err = jpeg.Encode(out, dst, &jpeg.Options{Quality: 80})
+		return out.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(out, dst)
+	return out.Bytes(), "image/png", err
+}
+
+// fit scales width x height down, keeping the aspect ratio, so that neither
+// side is larger than size.
+func fit(width int, height int, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
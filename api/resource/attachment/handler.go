@@ -0,0 +1,465 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thaironsilva/messenger/api/blobstore"
+	"github.com/thaironsilva/messenger/api/cognitoClient"
+	"github.com/thaironsilva/messenger/api/media"
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+var badRequestResponse = []byte(`{"message":"bad request"}`)
+var forbiddenResponse = []byte(`{"message":"invalid or expired link"}`)
+var methodNotAllowedResponse = []byte(`{"message":"method not allowed"}`)
+var notFoundResponse = []byte(`{"message":"attachment not found"}`)
+var tooLargeResponse = []byte(`{"message":"attachment too large"}`)
+var unauthorizedResponse = []byte(`{"message":"unauthorized token"}`)
+var unsupportedTypeResponse = []byte(`{"message":"unsupported attachment type"}`)
+var userNotFoundResponse = []byte(`{"message":"user not found"}`)
+
+// allowedTypes are the media types, as sniffed from the content rather than
+// trusted from the client, that can be uploaded.
+var allowedTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"audio/ogg":       true,
+	"application/ogg": true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// defaultMaxSize is the upload limit when ATTACHMENT_MAX_BYTES isn't set.
+const defaultMaxSize = 10 << 20
+
+type Storage interface {
+	Create(attachment Attachment) (Attachment, error)
+	GetById(id string) (Attachment, error)
+	GetParticipants(message_id string) (string, string, error)
+}
+
+// Queue takes uploaded attachments whose thumbnail or duration is worked
+// out in the background.
+type Queue interface {
+	Enqueue(id string)
+}
+
+type AttachmentHandler struct {
+	storage     Storage
+	blobs       blobstore.BlobStore
+	queue       Queue
+	userStorage user.Storage
+	cognito     cognitoClient.CognitoInterface
+}
+
+func NewHandler(storage Storage, blobs blobstore.BlobStore, queue Queue, userStorage user.Storage, cognito cognitoClient.CognitoInterface) AttachmentHandler {
+	return AttachmentHandler{
+		storage:     storage,
+		blobs:       blobs,
+		queue:       queue,
+		userStorage: userStorage,
+		cognito:     cognito,
+	}
+}
+
+// Upload stores the "file" part of a multipart request. The attachment is
+// sent later by referencing its id from a message. Images are stripped of
+// their metadata before being stored.
+func Upload(h AttachmentHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		uploader, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		limit := maxSize()
+		// leave room for the multipart headers around the file
+		r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			log.Println("Error reading upload:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		part, err := reader.NextPart()
+		for err == nil && part.FormName() != "file" {
+			part, err = reader.NextPart()
+		}
+		if err != nil {
+			log.Println("upload requires a file part:", err)
+			writeReadError(w, err)
+			return
+		}
+
+		head := make([]byte, 512)
+		n, err := io.ReadFull(part, head)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			log.Println("Error reading upload:", err)
+			writeReadError(w, err)
+			return
+		}
+		head = head[:n]
+
+		contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+		if !allowedTypes[contentType] {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write(unsupportedTypeResponse)
+			return
+		}
+
+		key, err := newKey()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		content := &countingReader{r: io.LimitReader(io.MultiReader(bytes.NewReader(head), part), limit+1)}
+		var width, height *int
+
+		if strings.HasPrefix(contentType, "image/") {
+			// images are small enough to be cleaned in memory
+			data, err := io.ReadAll(content)
+			if err != nil {
+				log.Println("Error reading upload:", err)
+				writeReadError(w, err)
+				return
+			}
+			if content.n > limit {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write(tooLargeResponse)
+				return
+			}
+
+			data, err = media.StripMetadata(contentType, data)
+			if err != nil {
+				log.Println("Error stripping upload metadata:", err)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(badRequestResponse)
+				return
+			}
+
+			if x, y, err := media.Dimensions(data); err == nil {
+				width, height = &x, &y
+			}
+
+			content = &countingReader{r: bytes.NewReader(data)}
+		}
+
+		if err := h.blobs.Put(key, content); err != nil {
+			log.Println("Error storing upload:", err)
+			writeReadError(w, err)
+			return
+		}
+
+		if content.n > limit {
+			h.blobs.Delete(key)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write(tooLargeResponse)
+			return
+		}
+
+		newAttachment := Attachment{
+			UploaderId:  uploader.Id,
+			FileName:    fileName(part.FileName()),
+			ContentType: contentType,
+			Size:        content.n,
+			StorageKey:  key,
+			CreatedAt:   time.Now().UTC(),
+			Width:       width,
+			Height:      height,
+		}
+
+		newAttachment, err = h.storage.Create(newAttachment)
+		if err != nil {
+			log.Println("Error occurred while trying to create attachment:", err)
+			h.blobs.Delete(key)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		h.queue.Enqueue(newAttachment.Id)
+		newAttachment.Sign(time.Now())
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newAttachment)
+	}
+}
+
+// Download serves an attachment to the users of its conversation, or to its
+// uploader before it is sent, who also hold a valid signed URL for it.
+func Download(h AttachmentHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		id := r.PathValue("id")
+		query := r.URL.Query()
+
+		if !verify(id, query.Get("expires"), query.Get("signature"), time.Now()) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(forbiddenResponse)
+			return
+		}
+
+		attachment, ok := h.load(w, r, id)
+		if !ok {
+			return
+		}
+
+		h.serve(w, attachment.StorageKey, attachment.ContentType, attachment.Size, attachment.FileName)
+	}
+}
+
+// DownloadThumbnail serves the thumbnail of an image attachment to the users
+// Download serves it to, who also hold a valid signed URL for it.
+func DownloadThumbnail(h AttachmentHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		id := r.PathValue("id")
+		query := r.URL.Query()
+
+		if !verify(thumbnailSubject(id), query.Get("expires"), query.Get("signature"), time.Now()) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(forbiddenResponse)
+			return
+		}
+
+		attachment, ok := h.load(w, r, id)
+		if !ok {
+			return
+		}
+
+		if attachment.ThumbnailKey == nil || attachment.ThumbnailContentType == nil || attachment.ThumbnailSize == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(notFoundResponse)
+			return
+		}
+
+		h.serve(w, *attachment.ThumbnailKey, *attachment.ThumbnailContentType, *attachment.ThumbnailSize, "thumbnail-"+attachment.FileName)
+	}
+}
+
+// load authenticates r and returns attachment id, provided the caller sent
+// or received the message it is linked to or, while it isn't linked yet,
+// uploaded it. Other callers are told it doesn't exist. When it can't, it
+// writes the error response and returns false.
+func (h AttachmentHandler) load(w http.ResponseWriter, r *http.Request, id string) (Attachment, bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	current, ok := h.authenticate(w, r)
+	if !ok {
+		return Attachment{}, false
+	}
+
+	attachment, err := h.storage.GetById(id)
+	if err != nil {
+		writeLoadError(w, err)
+		return attachment, false
+	}
+
+	allowed := attachment.UploaderId == current.Id
+
+	if attachment.MessageId != nil {
+		sender_id, receiver_id, err := h.storage.GetParticipants(*attachment.MessageId)
+		if err != nil {
+			writeLoadError(w, err)
+			return attachment, false
+		}
+		allowed = current.Id == sender_id || current.Id == receiver_id
+	}
+
+	if !allowed {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(notFoundResponse)
+		return attachment, false
+	}
+
+	return attachment, true
+}
+
+// serve writes the blob stored under key as the response body.
+func (h AttachmentHandler) serve(w http.ResponseWriter, key string, contentType string, size int64, name string) {
+	blob, err := h.blobs.Get(key)
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=600")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Println("Error sending attachment:", err)
+	}
+}
+
+// writeLoadError answers a failure to load an attachment or its blob.
+func writeLoadError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err.Error() == "sql: no rows in result set" || errors.Is(err, blobstore.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(notFoundResponse)
+		return
+	}
+	log.Println("Error loading attachment:", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+}
+
+// authenticate resolves the bearer token of r to a local user. When it
+// can't, it writes the error response and returns false.
+func (h AttachmentHandler) authenticate(w http.ResponseWriter, r *http.Request) (user.User, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(badRequestResponse)
+		return user.User{}, false
+	}
+
+	cognitoUser, err := h.cognito.GetUserByToken(token)
+
+	if err != nil {
+		if err.Error() == "NotAuthorizedException: Could not verify signature for Access Token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(unauthorizedResponse)
+			return user.User{}, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+		return user.User{}, false
+	}
+
+	var email string
+
+	for _, attribute := range cognitoUser.UserAttributes {
+		if *attribute.Name == "email" {
+			email = *attribute.Value
+		}
+	}
+
+	current, err := h.userStorage.GetByEmail(email)
+
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(userNotFoundResponse)
+			return current, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+		return current, false
+	}
+
+	return current, true
+}
+
+// writeReadError answers a failure to read the upload body, telling a body
+// over the size limit apart from a malformed one.
+func writeReadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write(tooLargeResponse)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(badRequestResponse)
+}
+
+// maxSize is the largest attachment accepted, in bytes.
+func maxSize() int64 {
+	if value := os.Getenv("ATTACHMENT_MAX_BYTES"); value != "" {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > 0 {
+			return size
+		}
+		log.Println("invalid ATTACHMENT_MAX_BYTES, using the default")
+	}
+	return defaultMaxSize
+}
+
+func fileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == "" {
+		return "attachment"
+	}
+	if len(name) > 255 {
+		name = strings.ToValidUTF8(name[len(name)-255:], "")
+	}
+	return name
+}
+
+func newKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
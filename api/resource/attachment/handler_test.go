@@ -0,0 +1,536 @@
+package attachment_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/thaironsilva/messenger/api/blobstore"
+	"github.com/thaironsilva/messenger/api/cognitoClient"
+	"github.com/thaironsilva/messenger/api/resource/attachment"
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+type MockStorage struct {
+	err        error
+	attachment attachment.Attachment
+	updated    *attachment.Attachment
+	// sender and receiver are the participants of every message.
+	sender   string
+	receiver string
+}
+
+func (m *MockStorage) Create(attachment attachment.Attachment) (attachment.Attachment, error) {
+	attachment.Id = "id"
+	return attachment, m.err
+}
+
+func (m *MockStorage) GetById(id string) (attachment.Attachment, error) {
+	return m.attachment, m.err
+}
+
+func (m *MockStorage) GetParticipants(message_id string) (string, string, error) {
+	return m.sender, m.receiver, m.err
+}
+
+func (m *MockStorage) UpdateMedia(attachment attachment.Attachment) error {
+	m.updated = &attachment
+	return m.err
+}
+
+type MockQueue struct {
+	ids []string
+}
+
+func (m *MockQueue) Enqueue(id string) {
+	m.ids = append(m.ids, id)
+}
+
+type MockBlobStore struct {
+	blobs map[string][]byte
+}
+
+func (m *MockBlobStore) Put(key string, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if m.blobs == nil {
+		m.blobs = make(map[string][]byte)
+	}
+	m.blobs[key] = content
+	return nil
+}
+
+func (m *MockBlobStore) Get(key string) (io.ReadCloser, error) {
+	content, ok := m.blobs[key]
+	if !ok {
+		return nil, blobstore.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (m *MockBlobStore) Delete(key string) error {
+	delete(m.blobs, key)
+	return nil
+}
+
+type MockUserStorage struct {
+	err   error
+	user  user.User
+	users []user.User
+}
+
+func (m *MockUserStorage) GetByUsername(username string) (user.User, error) {
+	return m.user, m.err
+}
+
+func (m *MockUserStorage) GetByEmail(email string) (user.User, error) {
+	return m.user, m.err
+}
+
+func (m *MockUserStorage) GetByString(name string) ([]user.User, error) {
+	return m.users, m.err
+}
+
+func (m *MockUserStorage) GetAll() ([]user.User, error) {
+	return m.users, m.err
+}
+
+func (m *MockUserStorage) Create(user user.User) error {
+	return m.err
+}
+
+func (m *MockUserStorage) Update(user user.User) error {
+	return m.err
+}
+
+func (m *MockUserStorage) Delete(id string) error {
+	return m.err
+}
+
+type MockCognito struct {
+	err   error
+	token string
+	user  cognito.GetUserOutput
+}
+
+func (m *MockCognito) SignUp(user *cognitoClient.CognitoUser) error {
+	return m.err
+}
+
+func (m *MockCognito) ConfirmAccount(user *cognitoClient.UserConfirmation) error {
+	return m.err
+}
+
+func (m *MockCognito) SignIn(user *cognitoClient.UserLogin) (string, error) {
+	return m.token, m.err
+}
+
+func (m *MockCognito) GetUserByToken(token string) (*cognito.GetUserOutput, error) {
+	return &m.user, m.err
+}
+
+func (m *MockCognito) UpdatePassword(user *cognitoClient.UserLogin) error {
+	return m.err
+}
+
+func (m *MockCognito) DeleteUser(token string) error {
+	return m.err
+}
+
+func pngImage(width int, height int) []byte {
+	out := &bytes.Buffer{}
+	png.Encode(out, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return out.Bytes()
+}
+
+// withTextChunk inserts a tEXt chunk, as cameras and editors write, right
+// after the IHDR chunk of a PNG.
+func withTextChunk(data []byte, text string) []byte {
+	chunk := make([]byte, 8, 12+len(text))
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	ihdrEnd := 8 + 12 + 13
+	return append(append(append([]byte(nil), data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+}
+
+func uploadRequest(content []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "picture.png")
+	part.Write(content)
+	writer.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/v0/attachments", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer token")
+	return req
+}
+
+func TestHanler_Upload(t *testing.T) {
+	type args struct {
+		cognito cognitoClient.CognitoInterface
+		storage attachment.Storage
+		maxSize string
+		r       func() *http.Request
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+		wantBlobs      int
+		wantQueued     int
+	}{
+		{
+			name: "upload_returns_201",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{},
+				r: func() *http.Request {
+					return uploadRequest(pngHeader)
+				},
+			},
+			wantStatusCode: http.StatusCreated,
+			wantBlobs:      1,
+			wantQueued:     1,
+		},
+		{
+			name: "upload_returns_400_when_image_is_malformed",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{},
+				r: func() *http.Request {
+					return uploadRequest(append(pngHeader, 0, 0, 0, 40, 'I', 'H', 'D', 'R'))
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "upload_returns_400_when_not_authorized",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{},
+				r: func() *http.Request {
+					req := uploadRequest(pngHeader)
+					req.Header.Del("Authorization")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "upload_returns_400_when_request_is_not_multipart",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/attachments", bytes.NewReader(pngHeader))
+					req.Header.Set("Authorization", "Bearer token")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "upload_returns_413_when_file_is_too_large",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{},
+				maxSize: "16",
+				r: func() *http.Request {
+					return uploadRequest(append(pngHeader, make([]byte, 16)...))
+				},
+			},
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "upload_returns_415_when_type_is_not_allowed",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{},
+				r: func() *http.Request {
+					return uploadRequest([]byte("<html><script>alert(1)</script></html>"))
+				},
+			},
+			wantStatusCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name: "upload_returns_500_and_removes_blob_when_storage_misbehaves",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{err: errors.New("something's wrong")},
+				r: func() *http.Request {
+					return uploadRequest(pngHeader)
+				},
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ATTACHMENT_MAX_BYTES", tt.args.maxSize)
+			blobs := &MockBlobStore{}
+			queue := &MockQueue{}
+			attachmentHandler := attachment.NewHandler(tt.args.storage, blobs, queue, &MockUserStorage{}, tt.args.cognito)
+			handler := attachment.Upload(attachmentHandler)
+			w := httptest.NewRecorder()
+			handler(w, tt.args.r())
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+			if len(blobs.blobs) != tt.wantBlobs {
+				t.Errorf("expected '%d' stored blobs but got '%d'", tt.wantBlobs, len(blobs.blobs))
+			}
+			if len(queue.ids) != tt.wantQueued {
+				t.Errorf("expected '%d' queued attachments but got '%d'", tt.wantQueued, len(queue.ids))
+			}
+		})
+	}
+}
+
+func TestHanler_UploadImage(t *testing.T) {
+	blobs := &MockBlobStore{}
+	attachmentHandler := attachment.NewHandler(&MockStorage{}, blobs, &MockQueue{}, &MockUserStorage{}, &MockCognito{})
+	handler := attachment.Upload(attachmentHandler)
+	w := httptest.NewRecorder()
+	handler(w, uploadRequest(withTextChunk(pngImage(40, 30), "GPS\x0048.85,2.35")))
+
+	result := w.Result()
+	if result.StatusCode != http.StatusCreated {
+		t.Fatalf("expected '%d' but got '%d'", http.StatusCreated, result.StatusCode)
+	}
+
+	var uploaded attachment.Attachment
+	json.NewDecoder(result.Body).Decode(&uploaded)
+	if uploaded.Width == nil || *uploaded.Width != 40 || uploaded.Height == nil || *uploaded.Height != 30 {
+		t.Errorf("expected dimensions '40x30' but got '%v x %v'", uploaded.Width, uploaded.Height)
+	}
+
+	for _, blob := range blobs.blobs {
+		if bytes.Contains(blob, []byte("tEXt")) {
+			t.Error("expected the text chunk to be stripped")
+		}
+		if int64(len(blob)) != uploaded.Size {
+			t.Errorf("expected size '%d' but got '%d'", len(blob), uploaded.Size)
+		}
+	}
+}
+
+func TestHanler_Download(t *testing.T) {
+	messageId := "message"
+	stored := attachment.Attachment{Id: "id", UploaderId: "id1", ContentType: "image/png", Size: int64(len(pngHeader)), StorageKey: "key"}
+	sent := stored
+	sent.MessageId = &messageId
+
+	tests := []struct {
+		name           string
+		storage        attachment.Storage
+		userStorage    user.Storage
+		token          string
+		url            string
+		wantStatusCode int
+	}{
+		{
+			name:           "download_returns_200_to_the_uploader_before_it_is_sent",
+			storage:        &MockStorage{attachment: stored},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id1"}},
+			token:          "token",
+			url:            attachment.SignedURL("id", time.Now()),
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "download_returns_200_to_the_receiver_of_the_message",
+			storage:        &MockStorage{attachment: sent, sender: "id1", receiver: "id2"},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id2"}},
+			token:          "token",
+			url:            attachment.SignedURL("id", time.Now()),
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "download_returns_400_without_token",
+			storage:        &MockStorage{attachment: stored},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id1"}},
+			url:            attachment.SignedURL("id", time.Now()),
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "download_returns_404_to_others_before_it_is_sent",
+			storage:        &MockStorage{attachment: stored},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id2"}},
+			token:          "token",
+			url:            attachment.SignedURL("id", time.Now()),
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "download_returns_404_to_users_outside_the_conversation",
+			storage:        &MockStorage{attachment: sent, sender: "id1", receiver: "id2"},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id3"}},
+			token:          "token",
+			url:            attachment.SignedURL("id", time.Now()),
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "download_returns_403_without_signature",
+			storage:        &MockStorage{attachment: stored},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id1"}},
+			token:          "token",
+			url:            "/api/v0/attachments/id",
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "download_returns_403_when_url_expired",
+			storage:        &MockStorage{attachment: stored},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id1"}},
+			token:          "token",
+			url:            attachment.SignedURL("id", time.Now().Add(-time.Hour)),
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "download_returns_403_when_signed_for_another_attachment",
+			storage:        &MockStorage{attachment: stored},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id1"}},
+			token:          "token",
+			url:            strings.Replace(attachment.SignedURL("other", time.Now()), "other", "id", 1),
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "download_returns_404_when_attachment_does_not_exist",
+			storage:        &MockStorage{err: errors.New("sql: no rows in result set")},
+			userStorage:    &MockUserStorage{user: user.User{Id: "id1"}},
+			token:          "token",
+			url:            attachment.SignedURL("id", time.Now()),
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blobs := &MockBlobStore{blobs: map[string][]byte{"key": pngHeader}}
+			attachmentHandler := attachment.NewHandler(tt.storage, blobs, &MockQueue{}, tt.userStorage, &MockCognito{})
+			handler := attachment.Download(attachmentHandler)
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			req.SetPathValue("id", "id")
+			w := httptest.NewRecorder()
+			handler(w, req)
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+		})
+	}
+}
+
+func TestHanler_DownloadThumbnail(t *testing.T) {
+	key, contentType, size := "key-thumb", "image/png", int64(len(pngHeader))
+	messageId := "message"
+	stored := attachment.Attachment{Id: "id", UploaderId: "id1", MessageId: &messageId, ContentType: "image/png", Size: int64(len(pngHeader)), StorageKey: "key"}
+	thumbnailed := stored
+	thumbnailed.ThumbnailKey, thumbnailed.ThumbnailContentType, thumbnailed.ThumbnailSize = &key, &contentType, &size
+
+	tests := []struct {
+		name           string
+		storage        attachment.Storage
+		url            string
+		wantStatusCode int
+	}{
+		{
+			name:           "thumbnail_returns_200_with_signed_url",
+			storage:        &MockStorage{attachment: thumbnailed, sender: "id1", receiver: "id2"},
+			url:            attachment.SignedThumbnailURL("id", time.Now()),
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "thumbnail_returns_404_to_users_outside_the_conversation",
+			storage:        &MockStorage{attachment: thumbnailed, sender: "id2", receiver: "id3"},
+			url:            attachment.SignedThumbnailURL("id", time.Now()),
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "thumbnail_returns_403_with_download_url",
+			storage:        &MockStorage{attachment: thumbnailed},
+			url:            strings.Replace(attachment.SignedURL("id", time.Now()), "?", "/thumbnail?", 1),
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:           "thumbnail_returns_404_when_not_generated_yet",
+			storage:        &MockStorage{attachment: stored, sender: "id1", receiver: "id2"},
+			url:            attachment.SignedThumbnailURL("id", time.Now()),
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blobs := &MockBlobStore{blobs: map[string][]byte{"key": pngHeader, "key-thumb": pngHeader}}
+			attachmentHandler := attachment.NewHandler(tt.storage, blobs, &MockQueue{}, &MockUserStorage{user: user.User{Id: "id1"}}, &MockCognito{})
+			handler := attachment.DownloadThumbnail(attachmentHandler)
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			req.Header.Set("Authorization", "Bearer token")
+			req.SetPathValue("id", "id")
+			w := httptest.NewRecorder()
+			handler(w, req)
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+		})
+	}
+}
+
+func TestWorker_Process(t *testing.T) {
+	t.Run("process_stores_thumbnail_of_image", func(t *testing.T) {
+		storage := &MockStorage{attachment: attachment.Attachment{Id: "id", ContentType: "image/png", StorageKey: "key"}}
+		blobs := &MockBlobStore{blobs: map[string][]byte{"key": pngImage(1000, 500)}}
+
+		if err := attachment.NewWorker(storage, blobs).Process("id"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if storage.updated == nil || storage.updated.ThumbnailKey == nil {
+			t.Fatal("expected the thumbnail to be saved")
+		}
+
+		config, err := png.DecodeConfig(bytes.NewReader(blobs.blobs[*storage.updated.ThumbnailKey]))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if config.Width != 320 || config.Height != 160 {
+			t.Errorf("expected thumbnail '320x160' but got '%dx%d'", config.Width, config.Height)
+		}
+	})
+
+	t.Run("process_skips_types_without_media", func(t *testing.T) {
+		storage := &MockStorage{attachment: attachment.Attachment{Id: "id", ContentType: "application/pdf", StorageKey: "key"}}
+		blobs := &MockBlobStore{blobs: map[string][]byte{"key": []byte("%PDF-1.4")}}
+
+		if err := attachment.NewWorker(storage, blobs).Process("id"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if storage.updated != nil {
+			t.Error("expected nothing to be saved")
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package attachment
+
+import "time"
+
+type Attachment struct {
+	Id          string    `json:"id"`
+	UploaderId  string    `json:"uploaderId"`
+	MessageId   *string   `json:"messageId"`
+	FileName    string    `json:"fileName"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	StorageKey  string    `json:"-"`
+	CreatedAt   time.Time `json:"createdAt"`
+	URL         string    `json:"url"`
+	// Width and Height are set for images, DurationMs for the audio and
+	// video formats whose headers tell it.
+	Width      *int   `json:"width"`
+	Height     *int   `json:"height"`
+	DurationMs *int64 `json:"durationMs"`
+	// The thumbnail is generated in the background after the upload, so it
+	// may still be missing on a recent attachment.
+	ThumbnailKey         *string `json:"-"`
+	ThumbnailContentType *string `json:"-"`
+	ThumbnailSize        *int64  `json:"-"`
+	ThumbnailURL         string  `json:"thumbnailUrl,omitempty"`
+}
+
+// Sign sets the download URLs of the attachment. Only use it on attachments
+// the caller may see.
+func (a *Attachment) Sign(now time.Time) {
+	a.URL = SignedURL(a.Id, now)
+	if a.ThumbnailKey != nil {
+		a.ThumbnailURL = SignedThumbnailURL(a.Id, now)
+	}
+}
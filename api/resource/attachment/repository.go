@@ -0,0 +1,110 @@
+package attachment
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+var ErrInvalidAttachment = errors.New("attachment not found or already sent")
+
+type Repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+const selectAttachments = `SELECT id, uploader_id, message_id, file_name, content_type, size, storage_key, created_at,
+	width, height, duration_ms, thumbnail_key, thumbnail_content_type, thumbnail_size FROM attachments`
+
+func (r *Repository) Create(newAttachment Attachment) (Attachment, error) {
+	query := `INSERT INTO attachments (uploader_id, file_name, content_type, size, storage_key, created_at, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	err := r.db.QueryRow(query, newAttachment.UploaderId, newAttachment.FileName, newAttachment.ContentType,
+		newAttachment.Size, newAttachment.StorageKey, newAttachment.CreatedAt, newAttachment.Width, newAttachment.Height).Scan(&newAttachment.Id)
+	if err != nil {
+		return newAttachment, err
+	}
+	return newAttachment, nil
+}
+
+func (r *Repository) GetById(id string) (Attachment, error) {
+	return scanAttachment(r.db.QueryRow(selectAttachments+" WHERE id = $1", id))
+}
+
+// GetParticipants returns the sender and receiver of message_id, the users
+// its attachments may be downloaded by.
+func (r *Repository) GetParticipants(message_id string) (string, string, error) {
+	var sender_id, receiver_id string
+	err := r.db.QueryRow("SELECT sender_id, receiver_id FROM messages WHERE id = $1", message_id).Scan(&sender_id, &receiver_id)
+	return sender_id, receiver_id, err
+}
+
+// UpdateMedia saves the metadata and thumbnail worked out in the background.
+func (r *Repository) UpdateMedia(attachment Attachment) error {
+	query := `UPDATE attachments SET duration_ms = $2, thumbnail_key = $3, thumbnail_content_type = $4, thumbnail_size = $5
+		WHERE id = $1`
+	_, err := r.db.Exec(query, attachment.Id, attachment.DurationMs, attachment.ThumbnailKey, attachment.ThumbnailContentType, attachment.ThumbnailSize)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetByMessageIds lists the attachments of the given messages, keyed by
+// message id.
+func (r *Repository) GetByMessageIds(message_ids []string) (map[string][]Attachment, error) {
+	rows, err := r.db.Query(selectAttachments+" WHERE message_id = ANY($1) ORDER BY created_at", pq.Array(message_ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make(map[string][]Attachment)
+
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return attachments, err
+		}
+		attachments[*attachment.MessageId] = append(attachments[*attachment.MessageId], attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// Link attaches the given attachments to message_id as part of tx. Every one
+// of them must have been uploaded by uploader_id and not be part of another
+// message yet, otherwise ErrInvalidAttachment is returned.
+func (r *Repository) Link(tx *sql.Tx, message_id string, uploader_id string, ids []string) error {
+	query := "UPDATE attachments SET message_id = $1 WHERE id = ANY($2) AND uploader_id = $3 AND message_id IS NULL"
+	result, err := tx.Exec(query, message_id, pq.Array(ids), uploader_id)
+	if err != nil {
+		return err
+	}
+
+	linked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if linked != int64(len(ids)) {
+		return ErrInvalidAttachment
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAttachment(row scanner) (Attachment, error) {
+	var attachment Attachment
+	err := row.Scan(&attachment.Id, &attachment.UploaderId, &attachment.MessageId, &attachment.FileName,
+		&attachment.ContentType, &attachment.Size, &attachment.StorageKey, &attachment.CreatedAt,
+		&attachment.Width, &attachment.Height, &attachment.DurationMs, &attachment.ThumbnailKey, &attachment.ThumbnailContentType, &attachment.ThumbnailSize)
+	return attachment, err
+}
@@ -0,0 +1,77 @@
+package attachment
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// urlTTL is how long a signed download URL stays valid.
+const urlTTL = 15 * time.Minute
+
+var secret []byte
+var secretOnce sync.Once
+
+// urlSecret is the key download URLs are signed with. Without
+// ATTACHMENT_URL_SECRET a random one is used, so URLs stop working on restart
+// and are not shared between instances.
+func urlSecret() []byte {
+	secretOnce.Do(func() {
+		if value := os.Getenv("ATTACHMENT_URL_SECRET"); value != "" {
+			secret = []byte(value)
+			return
+		}
+		log.Println("ATTACHMENT_URL_SECRET is not set, signing attachment URLs with a random key")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	})
+	return secret
+}
+
+// SignedURL returns a URL that downloads attachment id until it expires. It
+// must only be handed to the participants of the conversation the attachment
+// belongs to, who still need their bearer token to use it.
+func SignedURL(id string, now time.Time) string {
+	return signedPath("/api/v0/attachments/"+url.PathEscape(id), id, now)
+}
+
+// SignedThumbnailURL is SignedURL for the thumbnail of attachment id.
+func SignedThumbnailURL(id string, now time.Time) string {
+	return signedPath("/api/v0/attachments/"+url.PathEscape(id)+"/thumbnail", thumbnailSubject(id), now)
+}
+
+// thumbnailSubject is what thumbnail URLs sign instead of the bare id, so a
+// thumbnail URL can't be turned into a download URL of the full file.
+func thumbnailSubject(id string) string {
+	return id + "/thumbnail"
+}
+
+func signedPath(path string, subject string, now time.Time) string {
+	expires := now.Add(urlTTL).Unix()
+	return fmt.Sprintf("%s?expires=%d&signature=%s", path, expires, sign(subject, expires))
+}
+
+func sign(id string, expires int64) string {
+	mac := hmac.New(sha256.New, urlSecret())
+	mac.Write([]byte(id + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a download URL's expires and signature query values.
+func verify(id string, expires string, signature string, now time.Time) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(sign(id, unix)))
+}
@@ -0,0 +1,124 @@
+package attachment
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/thaironsilva/messenger/api/blobstore"
+	"github.com/thaironsilva/messenger/api/media"
+)
+
+// thumbnailSize is the largest side, in pixels, of generated thumbnails.
+const thumbnailSize = 320
+
+// queueSize is how many uploads can wait for the worker before new ones are
+// left without a thumbnail.
+const queueSize = 64
+
+type MediaStorage interface {
+	GetById(id string) (Attachment, error)
+	UpdateMedia(attachment Attachment) error
+}
+
+// Worker generates thumbnails and reads durations of uploaded attachments
+// in the background, so uploads don't wait for them.
+type Worker struct {
+	storage MediaStorage
+	blobs   blobstore.BlobStore
+	jobs    chan string
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+func NewWorker(storage MediaStorage, blobs blobstore.BlobStore) *Worker {
+	return &Worker{
+		storage: storage,
+		blobs:   blobs,
+		jobs:    make(chan string, queueSize),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start processes the queued attachments until Stop is called.
+func (w *Worker) Start() {
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case id := <-w.jobs:
+				if err := w.Process(id); err != nil {
+					log.Println("Error processing attachment", id+":", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the attachment being processed, if any, and leaves the
+// queued ones without thumbnail. It must be called once.
+func (w *Worker) Stop() {
+	close(w.stop)
+	w.running.Wait()
+}
+
+// Enqueue schedules attachment id for processing without blocking. When the
+// queue is full the attachment is skipped, and is served without thumbnail.
+func (w *Worker) Enqueue(id string) {
+	select {
+	case w.jobs <- id:
+	default:
+		log.Println("attachment queue is full, skipping", id)
+	}
+}
+
+// Process generates the thumbnail of image attachment id, or reads the
+// duration of an audio or video one, and saves the result.
+func (w *Worker) Process(id string) error {
+	attachment, err := w.storage.GetById(id)
+	if err != nil {
+		return err
+	}
+
+	blob, err := w.blobs.Get(attachment.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	switch {
+	case strings.HasPrefix(attachment.ContentType, "image/"):
+		thumbnail, contentType, err := media.Thumbnail(blob, thumbnailSize)
+		if err != nil {
+			return err
+		}
+
+		key := attachment.StorageKey + "-thumb"
+		if err := w.blobs.Put(key, bytes.NewReader(thumbnail)); err != nil {
+			return err
+		}
+
+		size := int64(len(thumbnail))
+		attachment.ThumbnailKey = &key
+		attachment.ThumbnailContentType = &contentType
+		attachment.ThumbnailSize = &size
+	default:
+		duration, ok, err := media.Duration(attachment.ContentType, blob)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		ms := duration.Milliseconds()
+		attachment.DurationMs = &ms
+	}
+
+	return w.storage.UpdateMedia(attachment)
+}
@@ -2,36 +2,75 @@ package message
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/thaironsilva/messenger/api/cognitoClient"
+	"github.com/thaironsilva/messenger/api/resource/attachment"
 	"github.com/thaironsilva/messenger/api/resource/user"
 )
 
 var badRequestResponse = []byte(`{"message":"bad request"}`)
+var emptySearchResponse = []byte(`{"message":"search needs words or a filter"}`)
 var methodNotAllowedResponse = []byte(`{"message":"method not allowed"}`)
 var notFoundResponse = []byte(`{"message":"user not found"}`)
+var messageNotFoundResponse = []byte(`{"message":"message not found"}`)
 var unauthorizedResponse = []byte(`{"message":"unauthorized token"}`)
 
+var ErrInvalidReply = errors.New("replied message is not part of this conversation")
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 type Storage interface {
 	GetAll(sender_id string, receiver string) ([]Message, error)
-	Create(message Message) error
+	Create(message Message) (Message, error)
+	MarkDelivered(receiver_id string, ids []string, at time.Time) ([]string, error)
+	MarkRead(receiver_id string, sender_id string, at time.Time) ([]string, error)
+	GetById(id string) (Message, error)
+	GetReplies(id string) ([]Message, error)
+	AddReaction(message_id string, user_id string, emoji string, at time.Time) (bool, error)
+	RemoveReaction(message_id string, user_id string, emoji string) (bool, error)
+	GetReactions(message_ids []string, user_id string) (map[string][]Reaction, error)
+	Search(user_id string, filter SearchFilter) ([]SearchResult, error)
+	GetConversations(user_id string, limit int, offset int) ([]Conversation, error)
+	GetCursor(user_id string, peer_id string, device_id string) (int64, error)
+	AdvanceCursor(user_id string, peer_id string, device_id string, seq int64) error
+	GetUndelivered(user_id string, peer_id string, seq int64, limit int) ([]Message, error)
+	MarkDeliveredUpTo(receiver_id string, sender_id string, seq int64, at time.Time) ([]string, error)
+}
+
+// Notifier pushes an event to the live chat connection user "to" holds with
+// user "from", if there is one. Deliver pushes a message "from" sent without
+// a chat connection the same way, and to the other devices of "from".
+type Notifier interface {
+	Notify(from string, to string, event any)
+	Deliver(from string, to string, message Message)
 }
 
 type MessageHandler struct {
 	storage     Storage
 	userStorage user.Storage
 	cognito     cognitoClient.CognitoInterface
+	notifier    Notifier
 }
 
-func NewHandler(storage Storage, userStorage user.Storage, cognito cognitoClient.CognitoInterface) MessageHandler {
+func NewHandler(storage Storage, userStorage user.Storage, cognito cognitoClient.CognitoInterface, notifier Notifier) MessageHandler {
 	return MessageHandler{
 		storage:     storage,
 		userStorage: userStorage,
 		cognito:     cognito,
+		notifier:    notifier,
 	}
 }
 
@@ -45,84 +84,712 @@ func GetMessages(h MessageHandler) http.HandlerFunc {
 			return
 		}
 
-		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		sender, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		receiver, ok := h.getUser(w, strings.TrimPrefix(r.URL.Path, "/api/v0/messages/"))
+		if !ok {
+			return
+		}
+
+		messages, err := h.storage.GetAll(sender.Id, receiver.Id)
+
+		if err != nil {
+			log.Println("Error listing messages:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		if err := h.addReactions(sender, messages); err != nil {
+			log.Println("Error listing reactions:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		h.markDelivered(sender, receiver, messages)
+		signAttachments(messages)
+
+		err = json.NewEncoder(w).Encode(messages)
+
+		if err != nil {
+			log.Println("Error encoding messages:", err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// sendRequest is the body of Send.
+type sendRequest struct {
+	Body          string   `json:"body"`
+	Format        string   `json:"format"`
+	ReplyToId     *string  `json:"replyToId"`
+	AttachmentIds []string `json:"attachmentIds"`
+}
 
-		if token == "" {
+// Send stores a message from the token user to username and delivers it to
+// their live chat connections. A message sent again with the same
+// Idempotency-Key header isn't stored or delivered twice: the one first
+// stored is returned instead, with status 200.
+func Send(h MessageHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		sender, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Body == nil {
+			log.Println("send message requires a request body")
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(badRequestResponse)
 			return
 		}
 
-		cognitoUser, err := h.cognito.GetUserByToken(token)
+		var request sendRequest
 
-		if err != nil {
-			if err.Error() == "NotAuthorizedException: Could not verify signature for Access Token" {
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write(unauthorizedResponse)
-				return
-			}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Println("Error decoding message:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		receiver, ok := h.getUser(w, r.PathValue("username"))
+		if !ok {
+			return
+		}
+
+		newMessage := Message{
+			SenderId:      sender.Id,
+			ReceiverId:    receiver.Id,
+			Body:          request.Body,
+			Format:        request.Format,
+			ReplyToId:     request.ReplyToId,
+			AttachmentIds: request.AttachmentIds,
+			CreatedAt:     time.Now().UTC(),
+		}
+		if values, ok := r.Header["Idempotency-Key"]; ok {
+			newMessage.IdempotencyKey = &values[0]
+		}
+
+		err := Validate(newMessage)
+		if err == nil {
+			err = CheckReply(h.storage, newMessage)
+		}
+		if err == nil {
+			newMessage, err = Render(newMessage)
+		}
+		if err == nil {
+			newMessage, err = h.storage.Create(newMessage)
+		}
+
+		status := http.StatusCreated
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrDuplicateMessage):
+			status = http.StatusOK
+		case errors.Is(err, ErrKeyReused):
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf(`{"message":%q}`, err.Error())))
+			return
+		case errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrInvalidFormat), errors.Is(err, ErrMessageTooLong),
+			errors.Is(err, ErrInvalidKey), errors.Is(err, ErrInvalidReply), errors.Is(err, attachment.ErrInvalidAttachment):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf(`{"message":%q}`, err.Error())))
+			return
+		default:
+			log.Println("Error sending message:", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
 			return
 		}
 
-		var email string
+		if status == http.StatusCreated {
+			h.notifier.Deliver(sender.Username, receiver.Username, newMessage)
+		}
 
-		for _, attribute := range cognitoUser.UserAttributes {
-			if *attribute.Name == "email" {
-				email = *attribute.Value
-			}
+		// the delivered message keeps its attachments unsigned, as on the
+		// chat connection
+		response := newMessage
+		response.Attachments = slices.Clone(newMessage.Attachments)
+		messages := []Message{response}
+		signAttachments(messages)
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(messages[0])
+	}
+}
+
+// GetConversations lists the token user's conversations, most recently
+// active first. It is paginated by the optional limit (20 by default, up to
+// 100) and offset parameters.
+func GetConversations(h MessageHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
 		}
 
-		sender, err := h.userStorage.GetByEmail(email)
+		current, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		limit, err := parseInt(r.URL.Query().Get("limit"), defaultPageSize)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		offset, err := parseInt(r.URL.Query().Get("offset"), 0)
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		conversations, err := h.storage.GetConversations(current.Id, limit, offset)
 
 		if err != nil {
-			if err.Error() == "sql: no rows in result set" {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write(notFoundResponse)
-				return
-			}
+			log.Println("Error listing conversations:", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
 			return
 		}
 
-		username := strings.TrimPrefix(r.URL.Path, "/api/v0/messages/")
+		err = json.NewEncoder(w).Encode(conversations)
+
+		if err != nil {
+			log.Println("Error encoding conversations:", err)
+		}
+	}
+}
+
+// Search looks for the messages of the token user's conversations matching
+// the words of the q parameter, where the has:attachment operator keeps the
+// messages with attachments. It is narrowed by the optional from (sender
+// username), with-user (other participant username), after and before
+// (RFC 3339 times or YYYY-MM-DD dates) parameters. Without words, it lists
+// the messages passing the filters, but it needs one of them.
+func Search(h MessageHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-		if username == "" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		current, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		params := r.URL.Query()
+		filter := parseQuery(params.Get("q"))
+
+		var err error
+		filter.After, err = parseDate(params.Get("after"))
+		if err == nil {
+			filter.Before, err = parseDate(params.Get("before"))
+		}
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(badRequestResponse)
 			return
 		}
 
-		receiver, err := h.userStorage.GetByUsername(username)
+		if username := params.Get("from"); username != "" {
+			from, ok := h.getUser(w, username)
+			if !ok {
+				return
+			}
+			filter.FromId = from.Id
+		}
 
-		if err != nil {
-			if err.Error() == "sql: no rows in result set" {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write(notFoundResponse)
+		if username := params.Get("with-user"); username != "" {
+			with, ok := h.getUser(w, username)
+			if !ok {
 				return
 			}
+			filter.WithId = with.Id
+		}
+
+		if filter.Query == "" && !filter.Filtered() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(emptySearchResponse)
+			return
+		}
+
+		results, err := h.storage.Search(current.Id, filter)
+
+		if err != nil {
+			log.Println("Error searching messages:", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
 			return
 		}
 
-		messages, err := h.storage.GetAll(sender.Id, receiver.Id)
+		now := time.Now()
+		for i := range results {
+			for j := range results[i].Message.Attachments {
+				results[i].Message.Attachments[j].Sign(now)
+			}
+		}
+
+		err = json.NewEncoder(w).Encode(results)
 
 		if err != nil {
-			log.Println("Error listing messages:", err)
+			log.Println("Error encoding search results:", err)
+		}
+	}
+}
+
+func MarkRead(h MessageHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		reader, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		sender, ok := h.getUser(w, r.PathValue("username"))
+		if !ok {
+			return
+		}
+
+		now := time.Now().UTC()
+		ids, err := h.storage.MarkRead(reader.Id, sender.Id, now)
+
+		if err != nil {
+			log.Println("Error marking messages as read:", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
 			return
 		}
 
-		err = json.NewEncoder(w).Encode(messages)
+		receipt := Receipt{Type: ReceiptRead, MessageIds: ids, At: now}
+		if len(ids) > 0 {
+			h.notifier.Notify(reader.Username, sender.Username, receipt)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(receipt)
+	}
+}
+
+func GetReplies(h MessageHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		current, _, msg, ok := h.getConversationMessage(w, r)
+		if !ok {
+			return
+		}
+
+		replies, err := h.storage.GetReplies(msg.Id)
+
+		if err == nil {
+			err = h.addReactions(current, replies)
+		}
 
 		if err != nil {
-			log.Println("Error encoding messages:", err)
+			log.Println("Error listing replies:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		signAttachments(replies)
+
+		err = json.NewEncoder(w).Encode(replies)
+
+		if err != nil {
+			log.Println("Error encoding replies:", err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func AddReaction(h MessageHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		if r.Body == nil {
+			log.Println("add reaction requires a request body")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		var reaction Reaction
+
+		if err := json.NewDecoder(r.Body).Decode(&reaction); err != nil || !validEmoji(reaction.Emoji) {
+			log.Println("Error decoding reaction:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		current, peer, msg, ok := h.getConversationMessage(w, r)
+		if !ok {
+			return
+		}
+
+		added, err := h.storage.AddReaction(msg.Id, current.Id, reaction.Emoji, time.Now().UTC())
+		if err != nil {
+			log.Println("Error occurred while trying to add reaction:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		event := ReactionEvent{Type: ReactionAdded, MessageId: msg.Id, Emoji: reaction.Emoji, Username: current.Username}
+		if added {
+			h.notifier.Notify(current.Username, peer.Username, event)
+			h.notifier.Notify(peer.Username, current.Username, event)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(event)
+	}
+}
+
+func RemoveReaction(h MessageHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		emoji := r.PathValue("emoji")
+
+		if !validEmoji(emoji) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		current, peer, msg, ok := h.getConversationMessage(w, r)
+		if !ok {
+			return
+		}
+
+		removed, err := h.storage.RemoveReaction(msg.Id, current.Id, emoji)
+		if err != nil {
+			log.Println("Error occurred while trying to remove reaction:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		event := ReactionEvent{Type: ReactionRemoved, MessageId: msg.Id, Emoji: emoji, Username: current.Username}
+		if removed {
+			h.notifier.Notify(current.Username, peer.Username, event)
+			h.notifier.Notify(peer.Username, current.Username, event)
 		}
 
 		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(event)
+	}
+}
+
+// addReactions fills in the reactions to messages as seen by reader.
+func (h MessageHandler) addReactions(reader user.User, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		ids[i] = message.Id
+	}
+
+	reactions, err := h.storage.GetReactions(ids, reader.Id)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].Id]
+	}
+
+	return nil
+}
+
+// markDelivered flags the returned messages that sender sent to reader and
+// had not been delivered yet, and lets sender know.
+func (h MessageHandler) markDelivered(reader user.User, sender user.User, messages []Message) {
+	var ids []string
+
+	for _, message := range messages {
+		if message.SenderId == sender.Id && message.ReceiverId == reader.Id && message.DeliveredAt == nil {
+			ids = append(ids, message.Id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	delivered, err := h.storage.MarkDelivered(reader.Id, ids, now)
+
+	if err != nil {
+		log.Println("Error marking messages as delivered:", err)
+		return
+	}
+
+	// only the messages this request delivered, the others were delivered
+	// meanwhile, at another time
+	for i := range messages {
+		if slices.Contains(delivered, messages[i].Id) {
+			messages[i].DeliveredAt = &now
+		}
+	}
+
+	if len(delivered) > 0 {
+		h.notifier.Notify(reader.Username, sender.Username, Receipt{Type: ReceiptDelivered, MessageIds: delivered, At: now})
+	}
+}
+
+// authenticate resolves the bearer token of r to a local user. When it
+// can't, it writes the error response and returns false.
+func (h MessageHandler) authenticate(w http.ResponseWriter, r *http.Request) (user.User, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(badRequestResponse)
+		return user.User{}, false
+	}
+
+	cognitoUser, err := h.cognito.GetUserByToken(token)
+
+	if err != nil {
+		if err.Error() == "NotAuthorizedException: Could not verify signature for Access Token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(unauthorizedResponse)
+			return user.User{}, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+		return user.User{}, false
+	}
+
+	var email string
+
+	for _, attribute := range cognitoUser.UserAttributes {
+		if *attribute.Name == "email" {
+			email = *attribute.Value
+		}
+	}
+
+	current, err := h.userStorage.GetByEmail(email)
+
+	if err != nil {
+		writeUserError(w, err)
+		return current, false
+	}
+
+	return current, true
+}
+
+// getUser loads the user named username. When it can't, it writes the error
+// response and returns false.
+func (h MessageHandler) getUser(w http.ResponseWriter, username string) (user.User, bool) {
+	if username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(badRequestResponse)
+		return user.User{}, false
+	}
+
+	u, err := h.userStorage.GetByUsername(username)
+
+	if err != nil {
+		writeUserError(w, err)
+		return u, false
+	}
+
+	return u, true
+}
+
+// getConversationMessage authenticates r and loads the message with the "id"
+// path value, checking it belongs to the conversation between the token user
+// and the "username" path value. When it can't, it writes the error response
+// and returns false.
+func (h MessageHandler) getConversationMessage(w http.ResponseWriter, r *http.Request) (user.User, user.User, Message, bool) {
+	current, ok := h.authenticate(w, r)
+	if !ok {
+		return current, user.User{}, Message{}, false
+	}
+
+	peer, ok := h.getUser(w, r.PathValue("username"))
+	if !ok {
+		return current, peer, Message{}, false
+	}
+
+	msg, err := h.storage.GetById(r.PathValue("id"))
+
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(messageNotFoundResponse)
+			return current, peer, msg, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+		return current, peer, msg, false
+	}
+
+	if !msg.Between(current.Id, peer.Id) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(messageNotFoundResponse)
+		return current, peer, msg, false
+	}
+
+	return current, peer, msg, true
+}
+
+// signAttachments gives every attachment of messages its download URLs. Only
+// use it on messages the caller takes part in.
+func signAttachments(messages []Message) {
+	now := time.Now()
+
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			messages[i].Attachments[j].Sign(now)
+		}
+	}
+}
+
+// CheckReply makes sure the message m replies to, if any, belongs to the
+// same conversation as m.
+func CheckReply(storage Storage, m Message) error {
+	if m.ReplyToId == nil {
+		return nil
+	}
+
+	quoted, err := storage.GetById(*m.ReplyToId)
+
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return ErrInvalidReply
+		}
+		return err
+	}
+
+	if !quoted.Between(m.SenderId, m.ReceiverId) {
+		return ErrInvalidReply
+	}
+
+	return nil
+}
+
+// validEmoji accepts short strings made of symbols, leaving out letters,
+// digits, whitespace and control characters, in any script.
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > 32 || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseInt reads an optional integer parameter, returning fallback when it
+// is empty.
+func parseInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseQuery splits the has:attachment filter out of the search words q.
+func parseQuery(q string) SearchFilter {
+	var filter SearchFilter
+	var words []string
+
+	for _, word := range strings.Fields(q) {
+		if word == "has:attachment" {
+			filter.HasAttachment = true
+			continue
+		}
+		words = append(words, word)
+	}
+
+	filter.Query = strings.Join(words, " ")
+	return filter
+}
+
+// parseDate reads a search bound given as an RFC 3339 time or a date, which
+// stands for midnight UTC. An empty value is no bound.
+func parseDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	if err.Error() == "sql: no rows in result set" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(notFoundResponse)
+		return
 	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
 }
@@ -1,10 +1,15 @@
 package message_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
 	"github.com/thaironsilva/messenger/api/cognitoClient"
@@ -15,16 +20,79 @@ import (
 type MockStorage struct {
 	err      error
 	messages []message.Message
+	message  message.Message
+	ids      []string
+	// marked holds the ids passed to MarkDelivered.
+	marked []string
+	// unchanged makes AddReaction and RemoveReaction report no change.
+	unchanged bool
 }
 
 func (m *MockStorage) GetAll(sender_id string, receiver_id string) ([]message.Message, error) {
 	return m.messages, m.err
 }
 
-func (m *MockStorage) Create(message message.Message) error {
+func (m *MockStorage) Create(message message.Message) (message.Message, error) {
+	return message, m.err
+}
+
+func (m *MockStorage) MarkDelivered(receiver_id string, ids []string, at time.Time) ([]string, error) {
+	m.marked = append(m.marked, ids...)
+	return m.ids, m.err
+}
+
+func (m *MockStorage) MarkRead(receiver_id string, sender_id string, at time.Time) ([]string, error) {
+	return m.ids, m.err
+}
+
+func (m *MockStorage) GetById(id string) (message.Message, error) {
+	return m.message, m.err
+}
+
+func (m *MockStorage) GetReplies(id string) ([]message.Message, error) {
+	return m.messages, m.err
+}
+
+func (m *MockStorage) AddReaction(message_id string, user_id string, emoji string, at time.Time) (bool, error) {
+	return !m.unchanged, m.err
+}
+
+func (m *MockStorage) RemoveReaction(message_id string, user_id string, emoji string) (bool, error) {
+	return !m.unchanged, m.err
+}
+
+func (m *MockStorage) GetReactions(message_ids []string, user_id string) (map[string][]message.Reaction, error) {
+	return nil, m.err
+}
+
+func (m *MockStorage) Search(user_id string, filter message.SearchFilter) ([]message.SearchResult, error) {
+	var results []message.SearchResult
+	for _, msg := range m.messages {
+		results = append(results, message.SearchResult{Message: msg})
+	}
+	return results, m.err
+}
+
+func (m *MockStorage) GetConversations(user_id string, limit int, offset int) ([]message.Conversation, error) {
+	return nil, m.err
+}
+
+func (m *MockStorage) GetCursor(user_id string, peer_id string, device_id string) (int64, error) {
+	return 0, m.err
+}
+
+func (m *MockStorage) AdvanceCursor(user_id string, peer_id string, device_id string, seq int64) error {
 	return m.err
 }
 
+func (m *MockStorage) GetUndelivered(user_id string, peer_id string, seq int64, limit int) ([]message.Message, error) {
+	return nil, m.err
+}
+
+func (m *MockStorage) MarkDeliveredUpTo(receiver_id string, sender_id string, seq int64, at time.Time) ([]string, error) {
+	return m.ids, m.err
+}
+
 type MockUserStorage struct {
 	err   error
 	user  user.User
@@ -89,6 +157,19 @@ func (m *MockCognito) DeleteUser(token string) error {
 	return m.err
 }
 
+type MockNotifier struct {
+	events    []any
+	delivered []message.Message
+}
+
+func (m *MockNotifier) Notify(from string, to string, event any) {
+	m.events = append(m.events, event)
+}
+
+func (m *MockNotifier) Deliver(from string, to string, message message.Message) {
+	m.delivered = append(m.delivered, message)
+}
+
 func TestHanler_GetMessages(t *testing.T) {
 	type args struct {
 		cognito     cognitoClient.CognitoInterface
@@ -178,7 +259,7 @@ func TestHanler_GetMessages(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito)
+			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito, &MockNotifier{})
 			handler := message.GetMessages(messageHanlder)
 			w := httptest.NewRecorder()
 			handler(w, tt.args.r())
@@ -189,3 +270,880 @@ func TestHanler_GetMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestHanler_Send(t *testing.T) {
+	type args struct {
+		cognito     cognitoClient.CognitoInterface
+		storage     message.Storage
+		userStorage user.Storage
+		r           func() *http.Request
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+		wantDelivered  int
+	}{
+		{
+			name: "send_returns_201_and_delivers_the_message",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":"hello"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.Header.Set("Idempotency-Key", "key")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusCreated,
+			wantDelivered:  1,
+		},
+		{
+			name: "send_returns_200_when_message_was_already_sent",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{err: message.ErrDuplicateMessage},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":"hello"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.Header.Set("Idempotency-Key", "key")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "send_returns_401_before_reading_the_body",
+			args: args{
+				cognito:     &MockCognito{err: errors.New("NotAuthorizedException: Could not verify signature for Access Token")},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "send_returns_400_when_body_is_invalid",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "send_returns_400_when_message_is_empty",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":""}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "send_returns_400_when_idempotency_key_is_empty",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":"hello"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.Header.Set("Idempotency-Key", "")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "send_returns_409_when_idempotency_key_was_used_in_another_conversation",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{err: message.ErrKeyReused},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":"hello"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.Header.Set("Idempotency-Key", "key")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name: "send_returns_500_when_message_storage_misbehaves",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{err: errors.New("something's wrong")},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username", bytes.NewReader([]byte(`{"body":"hello"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &MockNotifier{}
+			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito, notifier)
+			handler := message.Send(messageHanlder)
+			w := httptest.NewRecorder()
+			handler(w, tt.args.r())
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+			if len(notifier.delivered) != tt.wantDelivered {
+				t.Errorf("expected '%d' delivered messages but got '%d'", tt.wantDelivered, len(notifier.delivered))
+			}
+		})
+	}
+}
+
+func TestHanler_GetMessagesMarksDelivered(t *testing.T) {
+	// the mock resolves the reader and the sender to the same user, id
+	storage := &MockStorage{
+		messages: []message.Message{
+			{Id: "received", SenderId: "id", ReceiverId: "id"},
+			{Id: "sent", SenderId: "id", ReceiverId: "someone"},
+			{Id: "delivered meanwhile", SenderId: "id", ReceiverId: "id"},
+		},
+		ids: []string{"received"},
+	}
+	userStorage := &MockUserStorage{user: user.User{Id: "id"}}
+	messageHanlder := message.NewHandler(storage, userStorage, &MockCognito{}, &MockNotifier{})
+
+	req, _ := http.NewRequest(http.MethodGet, "/messages/username", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	message.GetMessages(messageHanlder)(w, req)
+
+	if !slices.Equal(storage.marked, []string{"received", "delivered meanwhile"}) {
+		t.Errorf("expected the received messages to be marked but got '%v'", storage.marked)
+	}
+
+	var messages []message.Message
+	json.NewDecoder(w.Result().Body).Decode(&messages)
+	for _, m := range messages {
+		if (m.DeliveredAt != nil) != (m.Id == "received") {
+			t.Errorf("expected only 'received' to be delivered now but got '%s' at '%v'", m.Id, m.DeliveredAt)
+		}
+	}
+}
+
+func TestHanler_MarkRead(t *testing.T) {
+	type args struct {
+		cognito     cognitoClient.CognitoInterface
+		storage     message.Storage
+		userStorage user.Storage
+		r           func() *http.Request
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+		wantEvents     int
+	}{
+		{
+			name: "mark_read_returns_200_and_notifies_sender",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{ids: []string{"id"}},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/read", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusOK,
+			wantEvents:     1,
+		},
+		{
+			name: "mark_read_returns_200_without_notifying_when_nothing_changed",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/read", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "mark_read_returns_400_when_not_authorized",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/read", nil)
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "mark_read_returns_500_when_message_storage_misbehaves",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{
+					err: errors.New("something's wrong"),
+				},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/read", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &MockNotifier{}
+			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito, notifier)
+			handler := message.MarkRead(messageHanlder)
+			w := httptest.NewRecorder()
+			handler(w, tt.args.r())
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+			if len(notifier.events) != tt.wantEvents {
+				t.Errorf("expected '%d' events but got '%d'", tt.wantEvents, len(notifier.events))
+			}
+		})
+	}
+}
+
+func TestHanler_AddReaction(t *testing.T) {
+	type args struct {
+		cognito     cognitoClient.CognitoInterface
+		storage     message.Storage
+		userStorage user.Storage
+		r           func() *http.Request
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+		wantEvents     int
+	}{
+		{
+			name: "add_reaction_returns_201_and_notifies_both_participants",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/id/reactions", bytes.NewReader([]byte(`{"emoji":"👍"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusCreated,
+			wantEvents:     2,
+		},
+		{
+			name: "add_reaction_does_not_notify_when_the_reaction_already_exists",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{unchanged: true},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/id/reactions", bytes.NewReader([]byte(`{"emoji":"👍"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name: "add_reaction_returns_400_when_emoji_is_invalid",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/id/reactions", bytes.NewReader([]byte(`{"emoji":"thumbs up"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "add_reaction_returns_400_when_emoji_has_non_ascii_letters",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/id/reactions", bytes.NewReader([]byte(`{"emoji":"é"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "add_reaction_returns_404_when_message_is_from_another_conversation",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{message: message.Message{Id: "id", SenderId: "someone", ReceiverId: "someone else"}},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/id/reactions", bytes.NewReader([]byte(`{"emoji":"👍"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "add_reaction_returns_500_when_message_storage_misbehaves",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{
+					err: errors.New("something's wrong"),
+				},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/api/v0/messages/username/id/reactions", bytes.NewReader([]byte(`{"emoji":"👍"}`)))
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &MockNotifier{}
+			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito, notifier)
+			handler := message.AddReaction(messageHanlder)
+			w := httptest.NewRecorder()
+			handler(w, tt.args.r())
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+			if len(notifier.events) != tt.wantEvents {
+				t.Errorf("expected '%d' events but got '%d'", tt.wantEvents, len(notifier.events))
+			}
+		})
+	}
+}
+
+func TestHanler_RemoveReaction(t *testing.T) {
+	type args struct {
+		cognito     cognitoClient.CognitoInterface
+		storage     message.Storage
+		userStorage user.Storage
+		r           func() *http.Request
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+		wantEvents     int
+	}{
+		{
+			name: "remove_reaction_returns_200",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodDelete, "/api/v0/messages/username/id/reactions/👍", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					req.SetPathValue("emoji", "👍")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusOK,
+			wantEvents:     2,
+		},
+		{
+			name: "remove_reaction_does_not_notify_when_there_was_no_reaction",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{unchanged: true},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodDelete, "/api/v0/messages/username/id/reactions/👍", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					req.SetPathValue("emoji", "👍")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "remove_reaction_returns_400_when_not_authorized",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodDelete, "/api/v0/messages/username/id/reactions/👍", nil)
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					req.SetPathValue("emoji", "👍")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier := &MockNotifier{}
+			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito, notifier)
+			handler := message.RemoveReaction(messageHanlder)
+			w := httptest.NewRecorder()
+			handler(w, tt.args.r())
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+			if len(notifier.events) != tt.wantEvents {
+				t.Errorf("expected '%d' events but got '%d'", tt.wantEvents, len(notifier.events))
+			}
+		})
+	}
+}
+
+func TestHanler_GetReplies(t *testing.T) {
+	type args struct {
+		cognito     cognitoClient.CognitoInterface
+		storage     message.Storage
+		userStorage user.Storage
+		r           func() *http.Request
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+	}{
+		{
+			name: "get_replies_returns_200",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodGet, "/api/v0/messages/username/id/replies", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "get_replies_returns_404_when_message_is_from_another_conversation",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{message: message.Message{Id: "id", SenderId: "someone", ReceiverId: "someone else"}},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodGet, "/api/v0/messages/username/id/replies", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "get_replies_returns_500_when_message_storage_misbehaves",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{
+					err: errors.New("something's wrong"),
+				},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodGet, "/api/v0/messages/username/id/replies", nil)
+					req.Header.Set("Authorization", "Bearer token")
+					req.SetPathValue("username", "username")
+					req.SetPathValue("id", "id")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito, &MockNotifier{})
+			handler := message.GetReplies(messageHanlder)
+			w := httptest.NewRecorder()
+			handler(w, tt.args.r())
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+		})
+	}
+}
+
+func TestHanler_GetConversations(t *testing.T) {
+	tests := []struct {
+		name           string
+		storage        message.Storage
+		query          string
+		wantStatusCode int
+	}{
+		{
+			name:           "get_conversations_returns_200",
+			storage:        &MockStorage{},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "get_conversations_returns_200_with_pagination",
+			storage:        &MockStorage{},
+			query:          "limit=50&offset=100",
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "get_conversations_returns_400_when_limit_is_too_large",
+			storage:        &MockStorage{},
+			query:          "limit=1000",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "get_conversations_returns_400_when_offset_is_invalid",
+			storage:        &MockStorage{},
+			query:          "offset=-1",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "get_conversations_returns_500_when_message_storage_misbehaves",
+			storage:        &MockStorage{err: errors.New("something's wrong")},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageHanlder := message.NewHandler(tt.storage, &MockUserStorage{}, &MockCognito{}, &MockNotifier{})
+			handler := message.GetConversations(messageHanlder)
+			req, _ := http.NewRequest(http.MethodGet, "/api/v0/conversations?"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer token")
+			w := httptest.NewRecorder()
+			handler(w, req)
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+		})
+	}
+}
+
+func TestHanler_Search(t *testing.T) {
+	type args struct {
+		cognito     cognitoClient.CognitoInterface
+		storage     message.Storage
+		userStorage user.Storage
+		query       string
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+	}{
+		{
+			name: "search_returns_200",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{messages: []message.Message{{Id: "id", Body: "hello"}}},
+				userStorage: &MockUserStorage{},
+				query:       "q=hello+has:attachment&from=username&with-user=username&after=2024-01-01&before=2024-02-01T00:00:00Z",
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "search_returns_400_without_query",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				query:       "q=%20",
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "search_returns_400_when_date_is_invalid",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				query:       "q=hello&after=yesterday",
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "search_returns_200_with_filters_but_no_words",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				query:       "q=has:attachment",
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "search_returns_200_with_a_date_but_no_q",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				query:       "after=2024-01-01",
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "search_returns_404_when_with_user_does_not_exist",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{err: errors.New("sql: no rows in result set")},
+				query:       "q=hello&with-user=nobody",
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "search_returns_500_when_message_storage_misbehaves",
+			args: args{
+				cognito:     &MockCognito{},
+				storage:     &MockStorage{err: errors.New("something's wrong")},
+				userStorage: &MockUserStorage{},
+				query:       "q=hello",
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageHanlder := message.NewHandler(tt.args.storage, tt.args.userStorage, tt.args.cognito, &MockNotifier{})
+			handler := message.Search(messageHanlder)
+			req, _ := http.NewRequest(http.MethodGet, "/api/v0/messages/search?"+tt.args.query, nil)
+			req.Header.Set("Authorization", "Bearer token")
+			w := httptest.NewRecorder()
+			handler(w, req)
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCheckReply(t *testing.T) {
+	replyToId := "quoted"
+
+	tests := []struct {
+		name    string
+		storage message.Storage
+		message message.Message
+		wantErr error
+	}{
+		{
+			name:    "accepts_messages_that_are_not_replies",
+			storage: &MockStorage{err: errors.New("something's wrong")},
+			message: message.Message{SenderId: "a", ReceiverId: "b"},
+		},
+		{
+			name:    "accepts_replies_within_the_conversation",
+			storage: &MockStorage{message: message.Message{Id: replyToId, SenderId: "b", ReceiverId: "a"}},
+			message: message.Message{SenderId: "a", ReceiverId: "b", ReplyToId: &replyToId},
+		},
+		{
+			name:    "rejects_replies_to_other_conversations",
+			storage: &MockStorage{message: message.Message{Id: replyToId, SenderId: "b", ReceiverId: "c"}},
+			message: message.Message{SenderId: "a", ReceiverId: "b", ReplyToId: &replyToId},
+			wantErr: message.ErrInvalidReply,
+		},
+		{
+			name:    "rejects_replies_to_missing_messages",
+			storage: &MockStorage{err: errors.New("sql: no rows in result set")},
+			message: message.Message{SenderId: "a", ReceiverId: "b", ReplyToId: &replyToId},
+			wantErr: message.ErrInvalidReply,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := message.CheckReply(tt.storage, tt.message); err != tt.wantErr {
+				t.Errorf("expected '%v' but got '%v'", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	longKey := strings.Repeat("k", 256)
+
+	tests := []struct {
+		name      string
+		maxLength string
+		message   message.Message
+		wantErr   error
+	}{
+		{
+			name:    "accepts_plain_messages",
+			message: message.Message{Body: "hello"},
+		},
+		{
+			name:    "accepts_markdown_messages",
+			message: message.Message{Body: "**hello**", Format: message.FormatMarkdown},
+		},
+		{
+			name:    "accepts_messages_longer_than_255_characters",
+			message: message.Message{Body: strings.Repeat("a", 1000)},
+		},
+		{
+			name:    "rejects_empty_messages",
+			message: message.Message{},
+			wantErr: message.ErrEmptyMessage,
+		},
+		{
+			name:    "rejects_unknown_formats",
+			message: message.Message{Body: "<b>hello</b>", Format: "html"},
+			wantErr: message.ErrInvalidFormat,
+		},
+		{
+			name:      "rejects_bodies_over_the_configured_length",
+			maxLength: "4",
+			message:   message.Message{Body: "héllo"},
+			wantErr:   message.ErrMessageTooLong,
+		},
+		{
+			name:    "rejects_idempotency_keys_over_255_bytes",
+			message: message.Message{Body: "hello", IdempotencyKey: &longKey},
+			wantErr: message.ErrInvalidKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MESSAGE_MAX_LENGTH", tt.maxLength)
+			if err := message.Validate(tt.message); err != tt.wantErr {
+				t.Errorf("expected '%v' but got '%v'", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  message.Message
+		wantHTML string
+	}{
+		{
+			name:    "leaves_plain_messages_without_html",
+			message: message.Message{Body: "**hello**", Format: message.FormatPlain},
+		},
+		{
+			name:     "renders_markdown",
+			message:  message.Message{Body: "**hello**", Format: message.FormatMarkdown},
+			wantHTML: "<p><strong>hello</strong></p>\n",
+		},
+		{
+			name:     "drops_raw_html_tags",
+			message:  message.Message{Body: "hi <script>alert(1)</script>", Format: message.FormatMarkdown},
+			wantHTML: "<p>hi alert(1)</p>\n",
+		},
+		{
+			name:     "drops_script_links",
+			message:  message.Message{Body: "[click](javascript:alert(1))", Format: message.FormatMarkdown},
+			wantHTML: "<p>click</p>\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := message.Render(tt.message)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			html := ""
+			if rendered.BodyHTML != nil {
+				html = *rendered.BodyHTML
+			}
+			if html != tt.wantHTML {
+				t.Errorf("expected '%s' but got '%s'", tt.wantHTML, html)
+			}
+		})
+	}
+}
@@ -1,11 +1,196 @@
 package message
 
-import "time"
+import (
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/thaironsilva/messenger/api/resource/attachment"
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+
+	ReactionAdded   = "reaction.added"
+	ReactionRemoved = "reaction.removed"
+
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+
+	// previewLength is how many characters of a quoted message's body are
+	// embedded in its replies.
+	previewLength = 100
+
+	// defaultMaxLength is the body limit when MESSAGE_MAX_LENGTH isn't set.
+	defaultMaxLength = 4000
+
+	// maxKeyLength is the longest idempotency key accepted, in bytes.
+	maxKeyLength = 255
+)
 
 type Message struct {
-	Id         string
-	SenderId   string    `json:"senderId" binding:"required"`
-	ReceiverId string    `json:"receiverId" binding:"required"`
-	Body       string    `json:"body" binding:"required"`
-	CreatedAt  time.Time `json:"createdAt" binding:"required"`
+	Id string `json:"id"`
+	// Seq orders all messages by the time they were stored. Chat clients
+	// are replayed the messages after the last Seq they were sent.
+	Seq         int64                   `json:"seq"`
+	SenderId    string                  `json:"senderId" binding:"required"`
+	ReceiverId  string                  `json:"receiverId" binding:"required"`
+	Body        string                  `json:"body" binding:"required"`
+	Format      string                  `json:"format"`
+	BodyHTML    *string                 `json:"bodyHtml"`
+	CreatedAt   time.Time               `json:"createdAt" binding:"required"`
+	DeliveredAt *time.Time              `json:"deliveredAt"`
+	ReadAt      *time.Time              `json:"readAt"`
+	Reactions   []Reaction              `json:"reactions"`
+	ReplyToId   *string                 `json:"replyToId"`
+	ReplyTo     *Preview                `json:"replyTo,omitempty"`
+	Attachments []attachment.Attachment `json:"attachments"`
+	// AttachmentIds are the uploads to send along with a new message.
+	AttachmentIds []string `json:"-"`
+	// IdempotencyKey is chosen by the sender so that a message sent again,
+	// after a failure left them unsure it was stored, is only stored once.
+	IdempotencyKey *string `json:"-"`
+}
+
+var ErrEmptyMessage = errors.New("message needs a body or an attachment")
+var ErrInvalidFormat = errors.New("message format must be plain or markdown")
+var ErrMessageTooLong = errors.New("message body is too long")
+var ErrInvalidKey = errors.New("idempotency key must be 1 to 255 bytes")
+
+// ErrDuplicateMessage is returned by Storage.Create, along with the message
+// first stored, when the sender already sent one with the same
+// IdempotencyKey.
+var ErrDuplicateMessage = errors.New("message already sent")
+
+// ErrKeyReused is returned by Storage.Create when the sender's
+// IdempotencyKey belongs to a message sent to someone else.
+var ErrKeyReused = errors.New("idempotency key already used in another conversation")
+
+// Validate checks a message about to be sent. An empty Format stands for
+// FormatPlain.
+func Validate(m Message) error {
+	if m.Body == "" && len(m.AttachmentIds) == 0 {
+		return ErrEmptyMessage
+	}
+	if m.Format != "" && m.Format != FormatPlain && m.Format != FormatMarkdown {
+		return ErrInvalidFormat
+	}
+	if utf8.RuneCountInString(m.Body) > MaxLength() {
+		return ErrMessageTooLong
+	}
+	if m.IdempotencyKey != nil && (*m.IdempotencyKey == "" || len(*m.IdempotencyKey) > maxKeyLength) {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// MaxLength is the longest message body accepted, in characters.
+func MaxLength() int {
+	if value := os.Getenv("MESSAGE_MAX_LENGTH"); value != "" {
+		if length, err := strconv.Atoi(value); err == nil && length > 0 {
+			return length
+		}
+		log.Println("invalid MESSAGE_MAX_LENGTH, using the default")
+	}
+	return defaultMaxLength
+}
+
+// Preview is the compact form of a quoted message embedded in its replies.
+// Deleted is set, and the other fields left blank, once the quoted message
+// no longer exists.
+type Preview struct {
+	Id       string `json:"id"`
+	SenderId string `json:"senderId"`
+	Body     string `json:"body"`
+	Deleted  bool   `json:"deleted"`
+}
+
+func newPreview(id string, sender_id string, body string) *Preview {
+	if utf8.RuneCountInString(body) > previewLength {
+		body = string([]rune(body)[:previewLength]) + "…"
+	}
+	return &Preview{Id: id, SenderId: sender_id, Body: body}
+}
+
+// Between reports whether the message was exchanged between the two users,
+// in either direction.
+func (m Message) Between(user_id string, other_id string) bool {
+	return (m.SenderId == user_id && m.ReceiverId == other_id) || (m.SenderId == other_id && m.ReceiverId == user_id)
+}
+
+// Signed returns a copy of the message whose attachments have their
+// download URLs, leaving the message itself alone as it may be shared. Only
+// use it on messages the caller takes part in.
+func (m Message) Signed(now time.Time) Message {
+	m.Attachments = slices.Clone(m.Attachments)
+	for i := range m.Attachments {
+		m.Attachments[i].Sign(now)
+	}
+	return m
+}
+
+// Receipt tells a sender that some of their messages reached the receiver
+// (ReceiptDelivered) or were seen by them (ReceiptRead).
+type Receipt struct {
+	Type       string    `json:"type"`
+	MessageIds []string  `json:"messageIds"`
+	At         time.Time `json:"at"`
+}
+
+// Reaction is how many users reacted to a message with Emoji, and whether the
+// user asking is one of them.
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reactedByMe"`
+}
+
+// ReactionEvent is pushed to both participants of a conversation when
+// Username adds (ReactionAdded) or removes (ReactionRemoved) a reaction.
+type ReactionEvent struct {
+	Type      string `json:"type"`
+	MessageId string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	Username  string `json:"username"`
+}
+
+// Conversation is an entry of a user's inbox: the other participant, the
+// last message exchanged with them and how many of theirs are still unread.
+type Conversation struct {
+	User           user.User `json:"user"`
+	LastMessage    Preview   `json:"lastMessage"`
+	UnreadCount    int       `json:"unreadCount"`
+	LastActivityAt time.Time `json:"lastActivityAt"`
+}
+
+// SearchFilter narrows a full-text search to the messages matching Query and
+// the filters that are set. Without Query, all the messages passing the
+// filters match, newest first.
+type SearchFilter struct {
+	Query         string
+	FromId        string
+	WithId        string
+	After         *time.Time
+	Before        *time.Time
+	HasAttachment bool
+}
+
+// Filtered reports whether any filter is set besides Query.
+func (f SearchFilter) Filtered() bool {
+	return f.FromId != "" || f.WithId != "" || f.After != nil || f.Before != nil || f.HasAttachment
+}
+
+// SearchResult is a message matching a search, with an excerpt of its body
+// where the matched words are wrapped in <mark> tags. The rest of the excerpt
+// is HTML escaped.
+type SearchResult struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
 }
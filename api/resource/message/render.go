@@ -0,0 +1,40 @@
+package message
+
+import (
+	"bytes"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// policy allows the formatting markdown produces and nothing that runs or
+// loads on its own, such as scripts, styles or iframes. Links get
+// rel="nofollow noopener" and open in a new tab.
+var policy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}()
+
+// Render sets the BodyHTML of markdown messages from their Body. The HTML is
+// sanitized, so clients can display it as is. Plain messages are left
+// without HTML.
+func Render(m Message) (Message, error) {
+	if m.Format != FormatMarkdown {
+		m.BodyHTML = nil
+		return m, nil
+	}
+
+	out := &bytes.Buffer{}
+	if err := markdown.Convert([]byte(m.Body), out); err != nil {
+		return m, err
+	}
+
+	html := policy.Sanitize(out.String())
+	m.BodyHTML = &html
+	return m, nil
+}
@@ -2,21 +2,311 @@ package message
 
 import (
 	"database/sql"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thaironsilva/messenger/api/resource/attachment"
+)
+
+// messageColumns are the columns of messages m, and of the message q each
+// one quotes, in the order scanMessage expects.
+const messageColumns = `m.id, m.seq, m.sender_id, m.receiver_id, m.body, m.format, m.body_html, m.created_at, m.delivered_at, m.read_at,
+		m.reply_to_id, q.id, q.sender_id, q.body`
+
+const selectMessages = "SELECT " + messageColumns + `
+	FROM messages m LEFT JOIN messages q ON q.id = m.reply_to_id`
+
+// Search snippets come out of Postgres with the matches between these
+// private use characters, so they can be turned into <mark> tags once the
+// rest of the snippet is HTML escaped.
+const (
+	matchStart = "\ue000"
+	matchStop  = "\ue001"
 )
 
+// invalidTextRepresentation is the Postgres error code for a value that
+// can't be parsed as its column type, such as an id that isn't a uuid.
+const invalidTextRepresentation = "22P02"
+
+var headlineOptions = fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxWords=20, MinWords=5, MaxFragments=2`, matchStart, matchStop)
+
 type Repository struct {
-	db *sql.DB
+	db          *sql.DB
+	attachments *attachment.Repository
 }
 
 func NewRepository(db *sql.DB) *Repository {
 	return &Repository{
-		db: db,
+		db:          db,
+		attachments: attachment.NewRepository(db),
 	}
 }
 
 func (r *Repository) GetAll(sender_id string, receiver_id string) ([]Message, error) {
-	query := "SELECT * FROM messages WHERE (sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1) LIMIT 20"
-	rows, err := r.db.Query(query, sender_id, receiver_id)
+	query := selectMessages + `
+		WHERE (m.sender_id = $1 AND m.receiver_id = $2) OR (m.sender_id = $2 AND m.receiver_id = $1) LIMIT 20`
+	return r.queryMessages(query, sender_id, receiver_id)
+}
+
+func (r *Repository) GetById(id string) (Message, error) {
+	message, err := scanMessage(r.db.QueryRow(selectMessages+" WHERE m.id = $1", id))
+	if err, ok := err.(*pq.Error); ok && err.Code == invalidTextRepresentation {
+		return message, sql.ErrNoRows
+	}
+	if err != nil {
+		return message, err
+	}
+
+	messages := []Message{message}
+	err = r.addAttachments(messages)
+	return messages[0], err
+}
+
+// GetReplies lists the messages that quote message id, oldest first.
+func (r *Repository) GetReplies(id string) ([]Message, error) {
+	return r.queryMessages(selectMessages+" WHERE m.reply_to_id = $1 ORDER BY m.created_at", id)
+}
+
+// Create stores newMessage and links its AttachmentIds to it, all or
+// nothing. It fails with attachment.ErrInvalidAttachment when one of them
+// can't be sent by the message's sender. When the sender already used the
+// IdempotencyKey of newMessage, nothing is stored and Create returns the
+// message first sent with it and ErrDuplicateMessage, or ErrKeyReused if it
+// went to another receiver.
+func (r *Repository) Create(newMessage Message) (Message, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return newMessage, err
+	}
+	defer tx.Rollback()
+
+	if newMessage.Format == "" {
+		newMessage.Format = FormatPlain
+	}
+
+	// a concurrent insert with the same key makes this one wait for it, and
+	// skip the row once it commits
+	query := `INSERT INTO messages (sender_id, receiver_id, body, format, body_html, created_at, reply_to_id, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (sender_id, idempotency_key) DO NOTHING RETURNING id, seq`
+	err = tx.QueryRow(query, newMessage.SenderId, newMessage.ReceiverId, newMessage.Body, newMessage.Format, newMessage.BodyHTML,
+		newMessage.CreatedAt, newMessage.ReplyToId, newMessage.IdempotencyKey).Scan(&newMessage.Id, &newMessage.Seq)
+	if err == sql.ErrNoRows {
+		return r.getByKey(newMessage)
+	}
+	if err != nil {
+		return newMessage, err
+	}
+
+	if len(newMessage.AttachmentIds) > 0 {
+		if err := r.attachments.Link(tx, newMessage.Id, newMessage.SenderId, newMessage.AttachmentIds); err != nil {
+			return newMessage, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return newMessage, err
+	}
+
+	messages := []Message{newMessage}
+	err = r.addAttachments(messages)
+	return messages[0], err
+}
+
+// getByKey loads the message already sent with the IdempotencyKey of
+// newMessage.
+func (r *Repository) getByKey(newMessage Message) (Message, error) {
+	original, err := scanMessage(r.db.QueryRow(selectMessages+" WHERE m.sender_id = $1 AND m.idempotency_key = $2",
+		newMessage.SenderId, newMessage.IdempotencyKey))
+	if err != nil {
+		return newMessage, err
+	}
+	if original.ReceiverId != newMessage.ReceiverId {
+		return newMessage, ErrKeyReused
+	}
+
+	messages := []Message{original}
+	if err := r.addAttachments(messages); err != nil {
+		return newMessage, err
+	}
+	return messages[0], ErrDuplicateMessage
+}
+
+// GetConversations lists the conversations of user_id, most recently
+// active first, along with their last message and unread count.
+func (r *Repository) GetConversations(user_id string, limit int, offset int) ([]Conversation, error) {
+	query := `WITH last AS (
+			SELECT DISTINCT ON (peer_id) peer_id, id, sender_id, body, created_at
+			FROM (
+				SELECT receiver_id AS peer_id, id, sender_id, body, created_at FROM messages WHERE sender_id = $1
+				UNION ALL
+				SELECT sender_id AS peer_id, id, sender_id, body, created_at FROM messages WHERE receiver_id = $1
+			) m
+			ORDER BY peer_id, created_at DESC
+		)
+		SELECT u.id, u.username, u.email, last.id, last.sender_id, last.body, last.created_at,
+			(SELECT COUNT(*) FROM messages
+				WHERE receiver_id = $1 AND sender_id = last.peer_id AND read_at IS NULL)
+		FROM last JOIN users u ON u.id = last.peer_id
+		ORDER BY last.created_at DESC LIMIT $2 OFFSET $3`
+
+	rows, err := r.db.Query(query, user_id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+
+	for rows.Next() {
+		var conversation Conversation
+		var id, sender_id, body string
+		err := rows.Scan(&conversation.User.Id, &conversation.User.Username, &conversation.User.Email,
+			&id, &sender_id, &body, &conversation.LastActivityAt, &conversation.UnreadCount)
+		if err != nil {
+			return conversations, err
+		}
+		conversation.LastMessage = *newPreview(id, sender_id, body)
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+// Search ranks the messages of user_id's conversations against
+// filter.Query, best matches first. Messages of conversations user_id isn't
+// part of are never returned.
+func (r *Repository) Search(user_id string, filter SearchFilter) ([]SearchResult, error) {
+	args := []any{user_id, filter.Query, headlineOptions}
+	conditions := []string{"(m.sender_id = $1 OR m.receiver_id = $1)"}
+	// without words, every message passing the filters matches, with the
+	// same rank
+	if filter.Query != "" {
+		conditions = append(conditions, "m.search @@ tsq")
+	}
+
+	if filter.FromId != "" {
+		args = append(args, filter.FromId)
+		conditions = append(conditions, fmt.Sprintf("m.sender_id = $%d", len(args)))
+	}
+	if filter.WithId != "" {
+		args = append(args, filter.WithId)
+		conditions = append(conditions, fmt.Sprintf("(m.sender_id = $%[1]d OR m.receiver_id = $%[1]d)", len(args)))
+	}
+	if filter.After != nil {
+		args = append(args, *filter.After)
+		conditions = append(conditions, fmt.Sprintf("m.created_at >= $%d", len(args)))
+	}
+	if filter.Before != nil {
+		args = append(args, *filter.Before)
+		conditions = append(conditions, fmt.Sprintf("m.created_at < $%d", len(args)))
+	}
+	if filter.HasAttachment {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = m.id)")
+	}
+
+	query := "SELECT " + messageColumns + `, ts_headline('simple', m.body, tsq, $3), ts_rank(m.search, tsq) AS search_rank
+		FROM messages m LEFT JOIN messages q ON q.id = m.reply_to_id, websearch_to_tsquery('simple', $2) tsq
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY search_rank DESC, m.created_at DESC LIMIT 20`
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+
+	for rows.Next() {
+		var result SearchResult
+		var snippet string
+		result.Message, err = scanMessage(withColumns(rows, &snippet, &result.Rank))
+		if err != nil {
+			return results, err
+		}
+		result.Snippet = highlight(snippet)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return results, err
+	}
+
+	messages := make([]Message, len(results))
+	for i := range results {
+		messages[i] = results[i].Message
+	}
+	if err := r.addAttachments(messages); err != nil {
+		return results, err
+	}
+	for i := range results {
+		results[i].Message = messages[i]
+	}
+	return results, nil
+}
+
+// GetCursor returns the Seq of the last message peer_id sent that user_id's
+// device_id client acknowledged, or 0 when there is none. A device without
+// a cursor of its own starts from the most advanced one of user_id.
+func (r *Repository) GetCursor(user_id string, peer_id string, device_id string) (int64, error) {
+	query := `SELECT seq FROM delivery_cursors WHERE user_id = $1 AND peer_id = $2
+		ORDER BY device_id = $3 DESC, seq DESC LIMIT 1`
+	var seq int64
+	err := r.db.QueryRow(query, user_id, peer_id, device_id).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// AdvanceCursor records that user_id's device_id client acknowledged the
+// messages peer_id sent up to seq. The cursor never moves back.
+func (r *Repository) AdvanceCursor(user_id string, peer_id string, device_id string, seq int64) error {
+	query := `INSERT INTO delivery_cursors (user_id, peer_id, device_id, seq, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, peer_id, device_id) DO UPDATE SET seq = GREATEST(delivery_cursors.seq, EXCLUDED.seq), updated_at = EXCLUDED.updated_at`
+	_, err := r.db.Exec(query, user_id, peer_id, device_id, seq, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetUndelivered lists, in Seq order, up to limit messages peer_id sent to
+// user_id after seq.
+func (r *Repository) GetUndelivered(user_id string, peer_id string, seq int64, limit int) ([]Message, error) {
+	query := selectMessages + `
+		WHERE m.receiver_id = $1 AND m.sender_id = $2 AND m.seq > $3 ORDER BY m.seq LIMIT $4`
+	return r.queryMessages(query, user_id, peer_id, seq, limit)
+}
+
+// MarkDelivered sets delivered_at on the given messages addressed to
+// receiver_id and returns the ids that were not delivered before.
+func (r *Repository) MarkDelivered(receiver_id string, ids []string, at time.Time) ([]string, error) {
+	query := `UPDATE messages SET delivered_at = $3
+		WHERE receiver_id = $1 AND id = ANY($2) AND delivered_at IS NULL RETURNING id`
+	return r.updateIds(query, receiver_id, pq.Array(ids), at)
+}
+
+// MarkDeliveredUpTo sets delivered_at on the messages sender_id sent to
+// receiver_id up to seq and returns the ids that were not delivered before.
+func (r *Repository) MarkDeliveredUpTo(receiver_id string, sender_id string, seq int64, at time.Time) ([]string, error) {
+	query := `UPDATE messages SET delivered_at = $4
+		WHERE receiver_id = $1 AND sender_id = $2 AND seq <= $3 AND delivered_at IS NULL RETURNING id`
+	return r.updateIds(query, receiver_id, sender_id, seq, at)
+}
+
+// MarkRead sets read_at on every unread message sender_id sent to
+// receiver_id and returns the ids that changed.
+func (r *Repository) MarkRead(receiver_id string, sender_id string, at time.Time) ([]string, error) {
+	query := `UPDATE messages SET read_at = $3, delivered_at = COALESCE(delivered_at, $3)
+		WHERE receiver_id = $1 AND sender_id = $2 AND read_at IS NULL RETURNING id`
+	return r.updateIds(query, receiver_id, sender_id, at)
+}
+
+func (r *Repository) queryMessages(query string, args ...any) ([]Message, error) {
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -25,20 +315,154 @@ func (r *Repository) GetAll(sender_id string, receiver_id string) ([]Message, er
 	var messages []Message
 
 	for rows.Next() {
-		var message Message
-		if err := rows.Scan(&message.Id, &message.SenderId, &message.ReceiverId, &message.Body, &message.CreatedAt); err != nil {
+		message, err := scanMessage(rows)
+		if err != nil {
 			return messages, err
 		}
 		messages = append(messages, message)
 	}
-	return messages, nil
+	if err := rows.Err(); err != nil {
+		return messages, err
+	}
+	return messages, r.addAttachments(messages)
 }
 
-func (r *Repository) Create(newMessage Message) error {
-	query := "INSERT INTO messages (sender_id, receiver_id, body, created_at) VALUES ($1, $2, $3, $4)"
-	_, err := r.db.Exec(query, newMessage.SenderId, newMessage.ReceiverId, newMessage.Body, newMessage.CreatedAt)
+func (r *Repository) addAttachments(messages []Message) error {
+	var ids []string
+
+	for _, message := range messages {
+		ids = append(ids, message.Id)
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	attachments, err := r.attachments.GetByMessageIds(ids)
 	if err != nil {
 		return err
 	}
+
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].Id]
+	}
 	return nil
 }
+
+func (r *Repository) updateIds(query string, args ...any) ([]string, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// AddReaction reports whether the reaction was added, false when user_id
+// had already reacted to the message with emoji.
+func (r *Repository) AddReaction(message_id string, user_id string, emoji string, at time.Time) (bool, error) {
+	query := `INSERT INTO message_reactions (message_id, user_id, emoji, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`
+	return r.changed(query, message_id, user_id, emoji, at)
+}
+
+// RemoveReaction reports whether the reaction was removed, false when there
+// was none.
+func (r *Repository) RemoveReaction(message_id string, user_id string, emoji string) (bool, error) {
+	query := "DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3"
+	return r.changed(query, message_id, user_id, emoji)
+}
+
+// changed runs query and reports whether it touched any row.
+func (r *Repository) changed(query string, args ...any) (bool, error) {
+	result, err := r.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// GetReactions aggregates the reactions to the given messages, keyed by
+// message id, flagging the ones user_id made.
+func (r *Repository) GetReactions(message_ids []string, user_id string) (map[string][]Reaction, error) {
+	query := `SELECT message_id, emoji, COUNT(*), BOOL_OR(user_id = $2) FROM message_reactions
+		WHERE message_id = ANY($1) GROUP BY message_id, emoji ORDER BY MIN(created_at)`
+	rows, err := r.db.Query(query, pq.Array(message_ids), user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[string][]Reaction)
+
+	for rows.Next() {
+		var message_id string
+		var reaction Reaction
+		if err := rows.Scan(&message_id, &reaction.Emoji, &reaction.Count, &reaction.ReactedByMe); err != nil {
+			return reactions, err
+		}
+		reactions[message_id] = append(reactions[message_id], reaction)
+	}
+	return reactions, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// extraColumns scans the columns selected after the message columns into
+// extra.
+type extraColumns struct {
+	row   scanner
+	extra []any
+}
+
+func withColumns(row scanner, extra ...any) extraColumns {
+	return extraColumns{row: row, extra: extra}
+}
+
+func (e extraColumns) Scan(dest ...any) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+// highlight escapes a search snippet and wraps its matches in <mark> tags.
+func highlight(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, matchStart, "<mark>")
+	return strings.ReplaceAll(snippet, matchStop, "</mark>")
+}
+
+func scanMessage(row scanner) (Message, error) {
+	var message Message
+	var quoteId, quoteSenderId, quoteBody sql.NullString
+
+	err := row.Scan(&message.Id, &message.Seq, &message.SenderId, &message.ReceiverId, &message.Body, &message.Format, &message.BodyHTML, &message.CreatedAt, &message.DeliveredAt, &message.ReadAt,
+		&message.ReplyToId, &quoteId, &quoteSenderId, &quoteBody)
+	if err != nil {
+		return message, err
+	}
+
+	if message.ReplyToId != nil {
+		if quoteId.Valid {
+			message.ReplyTo = newPreview(quoteId.String, quoteSenderId.String, quoteBody.String)
+		} else {
+			message.ReplyTo = &Preview{Id: *message.ReplyToId, Deleted: true}
+		}
+	}
+
+	return message, nil
+}
@@ -0,0 +1,149 @@
+package ticket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thaironsilva/messenger/api/cognitoClient"
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+var badRequestResponse = []byte(`{"message":"bad request"}`)
+var methodNotAllowedResponse = []byte(`{"message":"method not allowed"}`)
+var unauthorizedResponse = []byte(`{"message":"unauthorized token"}`)
+var userNotFoundResponse = []byte(`{"message":"user not found"}`)
+
+type Storage interface {
+	Create(ticket Ticket) error
+	Redeem(token string, now time.Time) (Ticket, error)
+}
+
+type TicketHandler struct {
+	storage     Storage
+	userStorage user.Storage
+	cognito     cognitoClient.CognitoInterface
+}
+
+func NewHandler(storage Storage, userStorage user.Storage, cognito cognitoClient.CognitoInterface) TicketHandler {
+	return TicketHandler{
+		storage:     storage,
+		userStorage: userStorage,
+		cognito:     cognito,
+	}
+}
+
+// ticketRequest is the optional body of Create.
+type ticketRequest struct {
+	Conversation string `json:"conversation"`
+}
+
+// Create mints a ticket for the token user. With a "conversation" username
+// in the body, it opens /api/v0/chat/{conversation}; without, /api/v0/ws.
+func Create(h TicketHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(methodNotAllowedResponse)
+			return
+		}
+
+		current, ok := h.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		var request ticketRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(badRequestResponse)
+			return
+		}
+
+		newTicket := Ticket{
+			Token:     newToken(),
+			User:      current,
+			ExpiresAt: time.Now().UTC().Add(TTL),
+		}
+
+		if request.Conversation != "" {
+			peer, err := h.userStorage.GetByUsername(request.Conversation)
+			if err != nil {
+				writeUserError(w, err)
+				return
+			}
+			newTicket.PeerId = &peer.Id
+		}
+
+		if err := h.storage.Create(newTicket); err != nil {
+			log.Println("Error creating ticket:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		err := json.NewEncoder(w).Encode(newTicket)
+
+		if err != nil {
+			log.Println("Error encoding ticket:", err)
+		}
+	}
+}
+
+func (h TicketHandler) authenticate(w http.ResponseWriter, r *http.Request) (user.User, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(badRequestResponse)
+		return user.User{}, false
+	}
+
+	cognitoUser, err := h.cognito.GetUserByToken(token)
+
+	if err != nil {
+		if err.Error() == "NotAuthorizedException: Could not verify signature for Access Token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(unauthorizedResponse)
+			return user.User{}, false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+		return user.User{}, false
+	}
+
+	var email string
+
+	for _, attribute := range cognitoUser.UserAttributes {
+		if *attribute.Name == "email" {
+			email = *attribute.Value
+		}
+	}
+
+	current, err := h.userStorage.GetByEmail(email)
+
+	if err != nil {
+		writeUserError(w, err)
+		return current, false
+	}
+
+	return current, true
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	if err.Error() == "sql: no rows in result set" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(userNotFoundResponse)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(fmt.Sprintf(`{"message": %s}`, err)))
+}
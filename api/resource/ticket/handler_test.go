@@ -0,0 +1,256 @@
+package ticket_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/thaironsilva/messenger/api/cognitoClient"
+	"github.com/thaironsilva/messenger/api/resource/ticket"
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+type MockStorage struct {
+	err     error
+	created []ticket.Ticket
+}
+
+func (m *MockStorage) Create(newTicket ticket.Ticket) error {
+	m.created = append(m.created, newTicket)
+	return m.err
+}
+
+func (m *MockStorage) Redeem(token string, now time.Time) (ticket.Ticket, error) {
+	return ticket.Ticket{}, m.err
+}
+
+type MockUserStorage struct {
+	err   error
+	user  user.User
+	users []user.User
+}
+
+func (m *MockUserStorage) GetByUsername(username string) (user.User, error) {
+	return user.User{Id: "peer", Username: username}, m.err
+}
+
+func (m *MockUserStorage) GetByEmail(email string) (user.User, error) {
+	return m.user, nil
+}
+
+func (m *MockUserStorage) GetByString(name string) ([]user.User, error) {
+	return m.users, m.err
+}
+
+func (m *MockUserStorage) GetAll() ([]user.User, error) {
+	return m.users, m.err
+}
+
+func (m *MockUserStorage) Create(user user.User) error {
+	return m.err
+}
+
+func (m *MockUserStorage) Update(user user.User) error {
+	return m.err
+}
+
+func (m *MockUserStorage) Delete(id string) error {
+	return m.err
+}
+
+type MockCognito struct {
+	err   error
+	token string
+	user  cognito.GetUserOutput
+}
+
+func (m *MockCognito) SignUp(user *cognitoClient.CognitoUser) error {
+	return m.err
+}
+
+func (m *MockCognito) ConfirmAccount(user *cognitoClient.UserConfirmation) error {
+	return m.err
+}
+
+func (m *MockCognito) SignIn(user *cognitoClient.UserLogin) (string, error) {
+	return m.token, m.err
+}
+
+func (m *MockCognito) GetUserByToken(token string) (*cognito.GetUserOutput, error) {
+	return &m.user, m.err
+}
+
+func (m *MockCognito) UpdatePassword(user *cognitoClient.UserLogin) error {
+	return m.err
+}
+
+func (m *MockCognito) DeleteUser(token string) error {
+	return m.err
+}
+
+func ticketRequest(body string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/api/v0/chat/ticket", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	return req
+}
+
+func TestHanler_Create(t *testing.T) {
+	type args struct {
+		storage     *MockStorage
+		userStorage user.Storage
+		r           func() *http.Request
+	}
+
+	tests := []struct {
+		name           string
+		args           args
+		wantStatusCode int
+		wantPeerId     string
+	}{
+		{
+			name: "create_returns_201_with_socket_ticket",
+			args: args{
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					return ticketRequest("")
+				},
+			},
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name: "create_returns_201_with_conversation_ticket",
+			args: args{
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					return ticketRequest(`{"conversation":"user2"}`)
+				},
+			},
+			wantStatusCode: http.StatusCreated,
+			wantPeerId:     "peer",
+		},
+		{
+			name: "create_returns_404_when_conversation_user_is_not_found",
+			args: args{
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{err: errors.New("sql: no rows in result set")},
+				r: func() *http.Request {
+					return ticketRequest(`{"conversation":"nobody"}`)
+				},
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "create_returns_400_when_body_is_malformed",
+			args: args{
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					return ticketRequest(`{"conversation":`)
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "create_returns_400_when_not_authorized",
+			args: args{
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req := ticketRequest("")
+					req.Header.Del("Authorization")
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "create_returns_405_when_method_is_not_post",
+			args: args{
+				storage:     &MockStorage{},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodGet, "/api/v0/chat/ticket", nil)
+					return req
+				},
+			},
+			wantStatusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name: "create_returns_500_when_storage_misbehaves",
+			args: args{
+				storage:     &MockStorage{err: errors.New("something's wrong")},
+				userStorage: &MockUserStorage{},
+				r: func() *http.Request {
+					return ticketRequest("")
+				},
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ticketHandler := ticket.NewHandler(tt.args.storage, tt.args.userStorage, &MockCognito{})
+			handler := ticket.Create(ticketHandler)
+			w := httptest.NewRecorder()
+			handler(w, tt.args.r())
+			result := w.Result()
+			if result.StatusCode != tt.wantStatusCode {
+				t.Fatalf("expected '%d' but got '%d'", tt.wantStatusCode, result.StatusCode)
+			}
+			if result.StatusCode != http.StatusCreated {
+				return
+			}
+
+			var got ticket.Ticket
+			body, _ := io.ReadAll(result.Body)
+			json.Unmarshal(body, &got)
+			if len(got.Token) != 64 || !got.ExpiresAt.After(time.Now()) {
+				t.Errorf("expected a fresh ticket but got '%s'", body)
+			}
+
+			stored := tt.args.storage.created[0]
+			if stored.Token != got.Token {
+				t.Errorf("expected the returned ticket to be stored")
+			}
+			if tt.wantPeerId == "" && stored.PeerId != nil {
+				t.Errorf("expected no conversation but got '%s'", *stored.PeerId)
+			}
+			if tt.wantPeerId != "" && (stored.PeerId == nil || *stored.PeerId != tt.wantPeerId) {
+				t.Errorf("expected conversation '%s' but got '%v'", tt.wantPeerId, stored.PeerId)
+			}
+		})
+	}
+}
+
+func TestTicket_Allows(t *testing.T) {
+	peer := "peer"
+	tests := []struct {
+		name    string
+		ticket  ticket.Ticket
+		peer_id string
+		want    bool
+	}{
+		{name: "socket_ticket_opens_socket", ticket: ticket.Ticket{}, peer_id: "", want: true},
+		{name: "socket_ticket_doesnt_open_conversation", ticket: ticket.Ticket{}, peer_id: "peer", want: false},
+		{name: "conversation_ticket_opens_its_conversation", ticket: ticket.Ticket{PeerId: &peer}, peer_id: "peer", want: true},
+		{name: "conversation_ticket_doesnt_open_others", ticket: ticket.Ticket{PeerId: &peer}, peer_id: "other", want: false},
+		{name: "conversation_ticket_doesnt_open_socket", ticket: ticket.Ticket{PeerId: &peer}, peer_id: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ticket.Allows(tt.peer_id); got != tt.want {
+				t.Errorf("expected '%v' but got '%v'", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package ticket
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/thaironsilva/messenger/api/resource/user"
+)
+
+// TTL is how long a ticket stays valid.
+const TTL = 30 * time.Second
+
+var ErrInvalidTicket = errors.New("invalid or expired ticket")
+
+// Ticket lets a browser, which can't send an Authorization header with a
+// websocket handshake, open a socket as User. It is valid once, until
+// ExpiresAt, and only for the conversation with PeerId, or for /api/v0/ws
+// when PeerId is nil.
+type Ticket struct {
+	Token     string    `json:"ticket"`
+	User      user.User `json:"-"`
+	PeerId    *string   `json:"-"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Allows reports whether the ticket opens the conversation with peer_id,
+// or /api/v0/ws when peer_id is empty.
+func (t Ticket) Allows(peer_id string) bool {
+	if t.PeerId == nil {
+		return peer_id == ""
+	}
+	return *t.PeerId == peer_id
+}
+
+func newToken() string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// hash is what is stored of a token, so a leaked table opens no sockets.
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,53 @@
+package ticket
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type Repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{
+		db: db,
+	}
+}
+
+// Create stores newTicket, clearing the expired ones along the way.
+func (r *Repository) Create(newTicket Ticket) error {
+	if _, err := r.db.Exec("DELETE FROM ws_tickets WHERE expires_at < $1", newTicket.ExpiresAt.Add(-TTL)); err != nil {
+		return err
+	}
+
+	query := "INSERT INTO ws_tickets (token_hash, user_id, peer_id, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := r.db.Exec(query, hash(newTicket.Token), newTicket.User.Id, newTicket.PeerId, newTicket.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Redeem uses up the ticket of token, returning it with its user. Expired
+// and already used tickets are ErrInvalidTicket.
+func (r *Repository) Redeem(token string, now time.Time) (Ticket, error) {
+	query := `WITH redeemed AS (DELETE FROM ws_tickets WHERE token_hash = $1 RETURNING user_id, peer_id, expires_at)
+		SELECT u.id, u.username, u.email, redeemed.peer_id, redeemed.expires_at
+		FROM redeemed JOIN users u ON u.id = redeemed.user_id`
+
+	t := Ticket{Token: token}
+	err := r.db.QueryRow(query, hash(token)).Scan(&t.User.Id, &t.User.Username, &t.User.Email, &t.PeerId, &t.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, ErrInvalidTicket
+	}
+	if err != nil {
+		return t, err
+	}
+
+	if !t.ExpiresAt.After(now) {
+		return t, ErrInvalidTicket
+	}
+	return t, nil
+}
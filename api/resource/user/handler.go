@@ -14,6 +14,7 @@ import (
 var badRequestResponse = []byte(`{"message":"bad request"}`)
 var methodNotAllowedResponse = []byte(`{"message":"method not allowed"}`)
 var notFoundResponse = []byte(`{"message":"user not found"}`)
+var reservedUsernameResponse = []byte(`{"message":"username is reserved"}`)
 var unauthorizedResponse = []byte(`{"message":"unauthorized token"}`)
 
 type Storage interface {
@@ -181,6 +182,12 @@ func CreateUser(h UserHandler) http.HandlerFunc {
 			return
 		}
 
+		if Reserved(cognitoUser.NickName) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(reservedUsernameResponse)
+			return
+		}
+
 		err := h.cognito.SignUp(&cognitoUser)
 
 		if err != nil {
@@ -180,6 +180,18 @@ func TestHanler_CreateUser(t *testing.T) {
 			},
 			wantStatusCode: http.StatusBadRequest,
 		},
+		{
+			name: "create_returns_400_when_username_is_reserved",
+			args: args{
+				cognito: &MockCognito{},
+				storage: &MockStorage{},
+				r: func() *http.Request {
+					req, _ := http.NewRequest(http.MethodPost, "/users/", bytes.NewReader([]byte(`{"nickname":"search","email":"johndoe@email.com","password":"helloworld"}`)))
+					return req
+				},
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
 		{
 			name: "create_returns_400_when_request_body_is_invalid",
 			args: args{
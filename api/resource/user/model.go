@@ -1,7 +1,21 @@
 package user
 
+import (
+	"slices"
+	"strings"
+)
+
+// reservedUsernames would be shadowed by fixed routes, such as
+// GET /api/v0/messages/search next to GET /api/v0/messages/{username}.
+var reservedUsernames = []string{"search"}
+
 type User struct {
 	Id       string
 	Username string
 	Email    string
 }
+
+// Reserved reports whether username is kept from users for a route.
+func Reserved(username string) bool {
+	return slices.Contains(reservedUsernames, strings.ToLower(username))
+}
@@ -2,26 +2,57 @@ package router
 
 import (
 	"database/sql"
+	"expvar"
 	"net/http"
 
+	"github.com/thaironsilva/messenger/api/blobstore"
 	"github.com/thaironsilva/messenger/api/cognitoClient"
 	"github.com/thaironsilva/messenger/api/connectionManager"
+	"github.com/thaironsilva/messenger/api/resource/attachment"
 	"github.com/thaironsilva/messenger/api/resource/message"
+	"github.com/thaironsilva/messenger/api/resource/ticket"
 	"github.com/thaironsilva/messenger/api/resource/user"
 )
 
-func New(db *sql.DB) *http.ServeMux {
+// New returns the routes of the app, and the handler of its websocket
+// sessions and the attachment worker to shut down with the server.
+func New(db *sql.DB, blobs blobstore.BlobStore, broker connectionManager.Broker) (*http.ServeMux, *connectionManager.ConnectionHandler, *attachment.Worker) {
 	router := http.NewServeMux()
 
 	cognito := cognitoClient.NewCognitoClient()
 	messageRepository := message.NewRepository(db)
 	userRepository := user.NewRepository(db)
+	attachmentRepository := attachment.NewRepository(db)
+	ticketRepository := ticket.NewRepository(db)
 
-	connHandler := connectionManager.NewConnectionHandler(messageRepository, userRepository, cognito)
+	connHandler := connectionManager.NewConnectionHandler(messageRepository, userRepository, ticketRepository, cognito, broker)
 	router.HandleFunc("/api/v0/chat/{username}", connHandler.HandleConnections)
+	router.HandleFunc("POST /api/v0/chat/ticket", ticket.Create(ticket.NewHandler(ticketRepository, userRepository, cognito)))
+	router.HandleFunc("/api/v0/ws", connHandler.HandleSocket)
+	router.HandleFunc("GET /api/v0/events", connHandler.HandleEvents)
+	router.HandleFunc("POST /api/v0/events/received", connHandler.HandleReceived)
+	router.HandleFunc("GET /api/v0/poll", connHandler.HandlePoll)
+	expvar.Publish("websocket", expvar.Func(func() any {
+		return connHandler.Stats()
+	}))
 
-	messageHandler := message.NewHandler(messageRepository, userRepository, cognito)
+	messageHandler := message.NewHandler(messageRepository, userRepository, cognito, connHandler)
+	router.HandleFunc("GET /api/v0/conversations", message.GetConversations(messageHandler))
+	router.HandleFunc("GET /api/v0/messages/search", message.Search(messageHandler))
 	router.HandleFunc("GET /api/v0/messages/{username}", message.GetMessages(messageHandler))
+	router.HandleFunc("POST /api/v0/messages/{username}", message.Send(messageHandler))
+	router.HandleFunc("POST /api/v0/messages/{username}/read", message.MarkRead(messageHandler))
+	router.HandleFunc("GET /api/v0/messages/{username}/{id}/replies", message.GetReplies(messageHandler))
+	router.HandleFunc("POST /api/v0/messages/{username}/{id}/reactions", message.AddReaction(messageHandler))
+	router.HandleFunc("DELETE /api/v0/messages/{username}/{id}/reactions/{emoji}", message.RemoveReaction(messageHandler))
+
+	attachmentWorker := attachment.NewWorker(attachmentRepository, blobs)
+	attachmentWorker.Start()
+
+	attachmentHandler := attachment.NewHandler(attachmentRepository, blobs, attachmentWorker, userRepository, cognito)
+	router.HandleFunc("POST /api/v0/attachments", attachment.Upload(attachmentHandler))
+	router.HandleFunc("GET /api/v0/attachments/{id}", attachment.Download(attachmentHandler))
+	router.HandleFunc("GET /api/v0/attachments/{id}/thumbnail", attachment.DownloadThumbnail(attachmentHandler))
 
 	userHandler := user.NewHandler(userRepository, cognito)
 	router.HandleFunc("GET /api/v0/user", user.GetUser(userHandler))
@@ -32,5 +63,14 @@ func New(db *sql.DB) *http.ServeMux {
 	router.HandleFunc("PUT /api/v0/users/password", user.UpdatePassword(userHandler))
 	router.HandleFunc("DELETE /api/v0/users", user.DeleteUser(userHandler))
 
+	return router, connHandler, attachmentWorker
+}
+
+// Metrics returns the routes of the internal listener, which publishes the
+// expvar variables, the "websocket" stats among them, out of reach of the
+// public router.
+func Metrics() *http.ServeMux {
+	router := http.NewServeMux()
+	router.Handle("GET /debug/vars", expvar.Handler())
 	return router
 }
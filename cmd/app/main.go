@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/thaironsilva/messenger/api/router"
 	"github.com/thaironsilva/messenger/config"
@@ -11,15 +17,62 @@ import (
 func main() {
 	db := config.NewDB()
 
-	defer db.Close()
-
-	r := router.New(db)
+	broker := config.NewBroker(db)
+	r, connHandler, attachmentWorker := router.New(db, config.NewBlobStore(), broker)
 	server := &http.Server{
 		Addr:    ":8080",
 		Handler: r,
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal("Failed to start server:", err)
+	metrics := &http.Server{
+		Addr:    config.MetricsAddr(),
+		Handler: router.Metrics(),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	go func() {
+		if err := metrics.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start metrics server:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout())
+	defer cancel()
+
+	// stop accepting connections and let requests finish while the
+	// websocket sessions, which the server doesn't track, flush and close;
+	// event streams and long polls are requests, ended by the sessions'
+	// shutdown
+	sessionsClosed := make(chan error, 1)
+	go func() {
+		sessionsClosed <- connHandler.Shutdown(shutdownCtx)
+	}()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down server:", err)
+	}
+	if err := <-sessionsClosed; err != nil {
+		log.Println("Error closing websocket sessions:", err)
+	}
+	if err := metrics.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down metrics server:", err)
+	}
+
+	// the worker may be saving a thumbnail
+	attachmentWorker.Stop()
+
+	if closer, ok := broker.(io.Closer); ok {
+		closer.Close()
 	}
+	db.Close()
 }
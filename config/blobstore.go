@@ -0,0 +1,24 @@
+package config
+
+import (
+	"os"
+
+	"github.com/thaironsilva/messenger/api/blobstore"
+)
+
+func NewBlobStore() blobstore.BlobStore {
+	store, err := blobstore.NewLocalStore(blobStoreDir())
+
+	if err != nil {
+		panic(err)
+	}
+
+	return store
+}
+
+func blobStoreDir() string {
+	if dir := os.Getenv("BLOB_STORE_DIR"); dir != "" {
+		return dir
+	}
+	return "data/attachments"
+}
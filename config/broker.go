@@ -0,0 +1,27 @@
+package config
+
+import (
+	"database/sql"
+	"os"
+
+	"github.com/thaironsilva/messenger/api/connectionManager"
+)
+
+// NewBroker returns the broker live deliveries go through. Set
+// MESSAGE_BROKER=postgres when running several instances, so they deliver
+// to each other's users over the database.
+func NewBroker(db *sql.DB) connectionManager.Broker {
+	switch os.Getenv("MESSAGE_BROKER") {
+	case "", "memory":
+		return connectionManager.NewMemoryBroker()
+	case "postgres":
+		broker, err := connectionManager.NewPostgresBroker(db, databaseUrl())
+
+		if err != nil {
+			panic(err)
+		}
+
+		return broker
+	}
+	panic("MESSAGE_BROKER must be memory or postgres")
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+const defaultShutdownTimeout = 15 * time.Second
+
+// ShutdownTimeout is how long the server waits for requests to finish and
+// websocket sessions to flush on shutdown, set with SHUTDOWN_TIMEOUT. An
+// invalid value is logged and the default is used, rather than failing
+// while the server is stopping.
+func ShutdownTimeout() time.Duration {
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+
+		if err != nil || timeout <= 0 {
+			log.Println("Invalid SHUTDOWN_TIMEOUT", value+", using", defaultShutdownTimeout)
+			return defaultShutdownTimeout
+		}
+
+		return timeout
+	}
+	return defaultShutdownTimeout
+}
+
+// MetricsAddr is where the metrics listener serves GET /debug/vars, set
+// with METRICS_ADDR. It defaults to the loopback interface, as the metrics
+// are not authenticated.
+func MetricsAddr() string {
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		return addr
+	}
+	return "localhost:9090"
+}
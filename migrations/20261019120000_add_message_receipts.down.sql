@@ -0,0 +1,4 @@
+-- migration down for add_message_receipts
+ALTER TABLE messages
+    DROP COLUMN delivered_at,
+    DROP COLUMN read_at;
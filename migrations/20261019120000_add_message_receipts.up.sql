@@ -0,0 +1,4 @@
+-- migration up for add_message_receipts
+ALTER TABLE messages
+    ADD COLUMN delivered_at TIMESTAMP,
+    ADD COLUMN read_at TIMESTAMP;
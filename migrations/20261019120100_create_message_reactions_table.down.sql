@@ -0,0 +1,2 @@
+-- migration down for create_message_reactions_table
+DROP TABLE message_reactions;
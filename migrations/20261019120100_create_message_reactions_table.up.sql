@@ -0,0 +1,10 @@
+-- migration up for create_message_reactions_table
+CREATE TABLE message_reactions (
+    message_id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    emoji VARCHAR(32) NOT NULL CHECK (emoji <> ''),
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (message_id, user_id, emoji),
+    CONSTRAINT fk_message_reactions_message FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    CONSTRAINT fk_message_reactions_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
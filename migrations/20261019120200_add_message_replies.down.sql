@@ -0,0 +1,3 @@
+-- migration down for add_message_replies
+DROP INDEX messages_reply_to_id_idx;
+ALTER TABLE messages DROP COLUMN reply_to_id;
@@ -0,0 +1,3 @@
+-- migration up for add_message_replies
+ALTER TABLE messages ADD COLUMN reply_to_id uuid;
+CREATE INDEX messages_reply_to_id_idx ON messages (reply_to_id);
@@ -0,0 +1,4 @@
+-- migration down for create_attachments_table
+DELETE FROM messages WHERE body = '';
+ALTER TABLE messages ADD CONSTRAINT messages_body_check CHECK (body <> '');
+DROP TABLE attachments;
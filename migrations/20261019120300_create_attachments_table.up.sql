@@ -0,0 +1,16 @@
+-- migration up for create_attachments_table
+CREATE TABLE attachments (
+    id uuid DEFAULT gen_random_uuid() PRIMARY KEY,
+    uploader_id uuid NOT NULL,
+    message_id uuid,
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size BIGINT NOT NULL,
+    storage_key VARCHAR(255) UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    CONSTRAINT fk_attachments_uploader FOREIGN KEY(uploader_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT fk_attachments_message FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+CREATE INDEX attachments_message_id_idx ON attachments (message_id);
+-- messages made only of attachments have an empty body
+ALTER TABLE messages DROP CONSTRAINT messages_body_check;
@@ -0,0 +1,8 @@
+-- migration down for add_attachment_media
+ALTER TABLE attachments
+    DROP COLUMN width,
+    DROP COLUMN height,
+    DROP COLUMN duration_ms,
+    DROP COLUMN thumbnail_key,
+    DROP COLUMN thumbnail_content_type,
+    DROP COLUMN thumbnail_size;
@@ -0,0 +1,8 @@
+-- migration up for add_attachment_media
+ALTER TABLE attachments
+    ADD COLUMN width INT,
+    ADD COLUMN height INT,
+    ADD COLUMN duration_ms BIGINT,
+    ADD COLUMN thumbnail_key VARCHAR(255),
+    ADD COLUMN thumbnail_content_type VARCHAR(100),
+    ADD COLUMN thumbnail_size BIGINT;
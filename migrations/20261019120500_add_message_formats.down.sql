@@ -0,0 +1,5 @@
+-- migration down for add_message_formats
+ALTER TABLE messages
+    DROP COLUMN body_html,
+    DROP COLUMN format,
+    ALTER COLUMN body TYPE VARCHAR(255) USING LEFT(body, 255);
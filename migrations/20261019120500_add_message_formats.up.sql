@@ -0,0 +1,5 @@
+-- migration up for add_message_formats
+ALTER TABLE messages
+    ALTER COLUMN body TYPE TEXT,
+    ADD COLUMN format VARCHAR(16) NOT NULL DEFAULT 'plain' CHECK (format IN ('plain', 'markdown')),
+    ADD COLUMN body_html TEXT;
@@ -0,0 +1,4 @@
+-- migration down for add_message_search
+DROP INDEX messages_search_idx;
+
+ALTER TABLE messages DROP COLUMN search;
@@ -0,0 +1,5 @@
+-- migration up for add_message_search
+ALTER TABLE messages
+    ADD COLUMN search tsvector GENERATED ALWAYS AS (to_tsvector('simple', body)) STORED;
+
+CREATE INDEX messages_search_idx ON messages USING GIN (search);
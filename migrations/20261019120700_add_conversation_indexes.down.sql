@@ -0,0 +1,4 @@
+-- migration down for add_conversation_indexes
+DROP INDEX messages_unread_idx;
+DROP INDEX messages_receiver_id_created_at_idx;
+DROP INDEX messages_sender_id_created_at_idx;
@@ -0,0 +1,4 @@
+-- migration up for add_conversation_indexes
+CREATE INDEX messages_sender_id_created_at_idx ON messages (sender_id, created_at DESC);
+CREATE INDEX messages_receiver_id_created_at_idx ON messages (receiver_id, created_at DESC);
+CREATE INDEX messages_unread_idx ON messages (receiver_id, sender_id) WHERE read_at IS NULL;
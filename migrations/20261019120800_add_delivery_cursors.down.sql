@@ -0,0 +1,7 @@
+-- migration down for add_delivery_cursors
+DROP TABLE delivery_cursors;
+
+DROP INDEX messages_receiver_id_sender_id_seq_idx;
+DROP INDEX messages_seq_idx;
+
+ALTER TABLE messages DROP COLUMN seq;
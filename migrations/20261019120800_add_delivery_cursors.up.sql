@@ -0,0 +1,34 @@
+-- migration up for add_delivery_cursors
+CREATE SEQUENCE messages_seq_seq;
+
+ALTER TABLE messages ADD COLUMN seq BIGINT;
+
+UPDATE messages m SET seq = ordered.n
+FROM (SELECT id, ROW_NUMBER() OVER (ORDER BY created_at, id) AS n FROM messages) ordered
+WHERE m.id = ordered.id;
+
+SELECT setval('messages_seq_seq', COALESCE((SELECT MAX(seq) FROM messages), 0) + 1, false);
+
+ALTER TABLE messages
+    ALTER COLUMN seq SET DEFAULT nextval('messages_seq_seq'),
+    ALTER COLUMN seq SET NOT NULL;
+
+ALTER SEQUENCE messages_seq_seq OWNED BY messages.seq;
+
+CREATE UNIQUE INDEX messages_seq_idx ON messages (seq);
+CREATE INDEX messages_receiver_id_sender_id_seq_idx ON messages (receiver_id, sender_id, seq);
+
+CREATE TABLE delivery_cursors (
+    user_id uuid NOT NULL,
+    peer_id uuid NOT NULL,
+    seq BIGINT NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, peer_id),
+    CONSTRAINT fk_delivery_cursors_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT fk_delivery_cursors_peer FOREIGN KEY(peer_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- messages sent before cursors existed were already pushed or listed, so
+-- they are not replayed
+INSERT INTO delivery_cursors (user_id, peer_id, seq, updated_at)
+SELECT receiver_id, sender_id, MAX(seq), NOW() FROM messages GROUP BY receiver_id, sender_id;
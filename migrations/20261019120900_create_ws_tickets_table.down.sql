@@ -0,0 +1,2 @@
+-- migration down for create_ws_tickets_table
+DROP TABLE ws_tickets;
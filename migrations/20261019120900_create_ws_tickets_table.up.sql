@@ -0,0 +1,10 @@
+-- migration up for create_ws_tickets_table
+CREATE TABLE ws_tickets (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id uuid NOT NULL,
+    peer_id uuid,
+    expires_at TIMESTAMP NOT NULL,
+    CONSTRAINT fk_ws_tickets_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT fk_ws_tickets_peer FOREIGN KEY(peer_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX ws_tickets_expires_at_idx ON ws_tickets (expires_at);
@@ -0,0 +1,4 @@
+-- migration down for add_message_idempotency_keys
+ALTER TABLE messages DROP CONSTRAINT messages_sender_id_idempotency_key_key;
+
+ALTER TABLE messages DROP COLUMN idempotency_key;
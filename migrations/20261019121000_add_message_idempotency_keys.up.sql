@@ -0,0 +1,5 @@
+-- migration up for add_message_idempotency_keys
+ALTER TABLE messages ADD COLUMN idempotency_key VARCHAR(255);
+
+-- messages without a key are never duplicates, as NULLs are distinct
+ALTER TABLE messages ADD CONSTRAINT messages_sender_id_idempotency_key_key UNIQUE (sender_id, idempotency_key);
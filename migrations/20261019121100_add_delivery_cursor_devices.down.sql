@@ -0,0 +1,11 @@
+-- migration down for add_delivery_cursor_devices
+-- keeps the most advanced cursor of each conversation
+DELETE FROM delivery_cursors c
+USING delivery_cursors other
+WHERE c.user_id = other.user_id AND c.peer_id = other.peer_id
+    AND (c.seq, c.device_id) < (other.seq, other.device_id);
+
+ALTER TABLE delivery_cursors DROP CONSTRAINT delivery_cursors_pkey;
+ALTER TABLE delivery_cursors ADD PRIMARY KEY (user_id, peer_id);
+
+ALTER TABLE delivery_cursors DROP COLUMN device_id;
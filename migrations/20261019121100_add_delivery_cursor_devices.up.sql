@@ -0,0 +1,5 @@
+-- migration up for add_delivery_cursor_devices
+ALTER TABLE delivery_cursors ADD COLUMN device_id VARCHAR(64) NOT NULL DEFAULT '';
+
+ALTER TABLE delivery_cursors DROP CONSTRAINT delivery_cursors_pkey;
+ALTER TABLE delivery_cursors ADD PRIMARY KEY (user_id, peer_id, device_id);